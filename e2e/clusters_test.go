@@ -0,0 +1,261 @@
+package e2e
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/client-go/pkg/api/v1"
+)
+
+func Test_parseClusters(t *testing.T) {
+	file, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	kubeconfig := file.Name()
+
+	tests := []struct {
+		name string
+		list string
+		want []Cluster
+	}{
+		{
+			name: "context",
+			list: "prod",
+			want: []Cluster{{Name: "prod", Kubeconfig: "default", Context: "prod"}},
+		},
+		{
+			name: "context with an @",
+			list: "kubernetes-admin@kubernetes",
+			want: []Cluster{{Name: "kubernetes-admin@kubernetes", Kubeconfig: "default", Context: "kubernetes-admin@kubernetes"}},
+		},
+		{
+			name: "kubeconfig file",
+			list: kubeconfig,
+			want: []Cluster{{Name: kubeconfig, Kubeconfig: kubeconfig}},
+		},
+		{
+			name: "kubeconfig file and context",
+			list: kubeconfig + "@kubernetes-admin@kubernetes",
+			want: []Cluster{{Name: kubeconfig + "@kubernetes-admin@kubernetes", Kubeconfig: kubeconfig, Context: "kubernetes-admin@kubernetes"}},
+		},
+		{
+			name: "several",
+			list: " prod, ,staging ",
+			want: []Cluster{
+				{Name: "prod", Kubeconfig: "default", Context: "prod"},
+				{Name: "staging", Kubeconfig: "default", Context: "staging"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseClusters(test.list, "default"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseClusters(%q) = %+v, want %+v", test.list, got, test.want)
+			}
+		})
+	}
+}
+
+func Test_podTargetKey(t *testing.T) {
+	tests := []struct {
+		target PodTarget
+		want   string
+	}{
+		{PodTarget{Name: "web"}, "web"},
+		{PodTarget{Name: "web", Match: MatchSubstring}, "web"},
+		{PodTarget{Name: "web", Match: MatchExact}, "exact:web"},
+		{PodTarget{Name: "^web-", Match: MatchRegex}, "regex:^web-"},
+		{PodTarget{Selector: map[string]string{"app": "a"}}, "{app=a}"},
+		{PodTarget{Name: "web", Selector: map[string]string{"tier": "front", "app": "a"}}, "{app=a,tier=front}"},
+		{PodTarget{Name: "operator", Namespace: "ops"}, "ops/operator"},
+	}
+	for _, test := range tests {
+		if got := test.target.key(); got != test.want {
+			t.Errorf("%+v.key() = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func Test_podTargetMatches(t *testing.T) {
+	pod := func(name string) v1.Pod {
+		return v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	}
+	tests := []struct {
+		name    string
+		target  PodTarget
+		matches []string
+		misses  []string
+		wantErr bool
+	}{
+		{
+			name:    "substring",
+			target:  PodTarget{Name: "web"},
+			matches: []string{"web", "my-web-1"},
+			misses:  []string{"db-1"},
+		},
+		{
+			name:    "exact",
+			target:  PodTarget{Name: "web", Match: MatchExact},
+			matches: []string{"web"},
+			misses:  []string{"web-1"},
+		},
+		{
+			name:    "regex",
+			target:  PodTarget{Name: "^web-[0-9]+$", Match: MatchRegex},
+			matches: []string{"web-1", "web-22"},
+			misses:  []string{"web", "my-web-1", "web-a"},
+		},
+		{
+			name:    "invalid regex",
+			target:  PodTarget{Name: "web-(", Match: MatchRegex},
+			wantErr: true,
+		},
+		{
+			name:    "unknown match",
+			target:  PodTarget{Name: "web", Match: "glob"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := test.target
+			err := target.compile()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("no error compiling the target")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the regex is compiled once and reused for every pod
+			regex := target.regex
+			for _, name := range test.matches {
+				if !target.matches(pod(name)) {
+					t.Errorf("%q does not match pod %q", target.Name, name)
+				}
+			}
+			for _, name := range test.misses {
+				if target.matches(pod(name)) {
+					t.Errorf("%q matches pod %q", target.Name, name)
+				}
+			}
+			if target.regex != regex {
+				t.Error("the regex was compiled again while matching")
+			}
+		})
+	}
+
+	// a regex target that was never compiled matches no pod
+	target := PodTarget{Name: "web", Match: MatchRegex}
+	if target.matches(pod("web")) {
+		t.Error("an uncompiled regex target matches a pod")
+	}
+}
+
+func Test_validateTestDataPodTargets(t *testing.T) {
+	tests := []struct {
+		name       string
+		podStarted []string
+		targets    []PodTarget
+		wantErr    string
+	}{
+		{
+			name:       "selectors and names",
+			podStarted: []string{"web"},
+			targets: []PodTarget{
+				{Selector: map[string]string{"app": "a"}},
+				{Selector: map[string]string{"app": "b"}},
+				{Name: "web", Selector: map[string]string{"app": "c"}},
+			},
+		},
+		{
+			name:       "name twice",
+			podStarted: []string{"web"},
+			targets:    []PodTarget{{Name: "web"}},
+			wantErr:    "more than once",
+		},
+		{
+			name: "selector twice",
+			targets: []PodTarget{
+				{Selector: map[string]string{"app": "a"}},
+				{Name: "other", Selector: map[string]string{"app": "a"}},
+			},
+			wantErr: "more than once",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := testData{
+				TestName:   test.name,
+				Namespace:  "test",
+				Input:      "name: web",
+				PodStarted: test.podStarted,
+				PodTargets: test.targets,
+			}
+			err := validateTestData(&data, "")
+			if test.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("error %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func Test_isList(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"- testName: wordpress\n", true},
+		{"[]", true},
+		{"name: db\ncontainers:\n- image: mariadb\n", false},
+		{"# kedge file\n---\nname: db\n", false},
+		// reported by the parser instead of skipped
+		{"{", true},
+	}
+	for _, test := range tests {
+		if got := isList([]byte(test.data)); got != test.want {
+			t.Errorf("isList(%q) = %v, want %v", test.data, got, test.want)
+		}
+	}
+}
+
+func Test_LoadTestDataDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testcases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"wordpress.yaml": "- testName: wordpress\n  namespace: wordpress\n  inputFiles:\n  - db.yaml\n",
+		"db.yaml":        "name: db\ncontainers:\n- image: mariadb\n",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests, err := LoadTestData(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 1 || tests[0].TestName != "wordpress" {
+		t.Fatalf("got tests %+v, want only wordpress", tests)
+	}
+	if want := []string{filepath.Join(dir, "db.yaml")}; !reflect.DeepEqual(tests[0].InputFiles, want) {
+		t.Errorf("got input files %q, want %q", tests[0].InputFiles, want)
+	}
+}
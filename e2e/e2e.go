@@ -1 +1,380 @@
 package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// KappResult is what a run of kedge produced
+type KappResult struct {
+	Args     []string
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// KappTimeout is how long kedge may run before it is killed, unless the Runner
+// sets its own
+var KappTimeout = 2 * time.Minute
+
+// KubectlTimeout is how long kubectl may run before it is killed, unless the
+// Runner sets its own
+var KubectlTimeout = 2 * time.Minute
+
+// The kedge subcommands the tests run
+const (
+	// KappGenerate only prints the manifests, the tests deploy them
+	KappGenerate = "generate"
+	// KappApply deploys the manifests with kedge itself
+	KappApply = "apply"
+)
+
+// Runner runs kedge and kubectl, for programs that embed the tests
+type Runner struct {
+	// KappLoc and KubectlLoc are the paths of the kedge and kubectl binaries
+	KappLoc    string
+	KubectlLoc string
+	// KubectlArgs go before the arguments of every kubectl command, e.g.
+	// "--kubeconfig" and "--context"
+	KubectlArgs []string
+	// GenerateCommand, when set, generates the manifests instead of "kedge
+	// generate", e.g. to compare kedge with another tool. It is a template
+	// of the command line, given the Files and the extra Args, e.g.
+	// "kompose convert --stdout -f {{join .Files \",\"}}". The command line
+	// is split on the spaces outside of {{ }} first, then every argument is
+	// rendered on its own, so the files may hold spaces. An argument of
+	// only {{.Files}} or {{.Args}} becomes one argument per file or arg.
+	GenerateCommand string
+	// KappTimeout and KubectlTimeout are how long kedge, or the
+	// GenerateCommand, and kubectl may run before they are killed, default
+	// to the package KappTimeout and KubectlTimeout
+	KappTimeout    time.Duration
+	KubectlTimeout time.Duration
+	// Logf logs the output of kubectl as it comes, defaults to log.Printf
+	Logf func(format string, args ...interface{})
+}
+
+func (r *Runner) kappTimeout() time.Duration {
+	if r.KappTimeout == 0 {
+		return KappTimeout
+	}
+	return r.KappTimeout
+}
+
+func (r *Runner) kubectlTimeout() time.Duration {
+	if r.KubectlTimeout == 0 {
+		return KubectlTimeout
+	}
+	return r.KubectlTimeout
+}
+
+func (r *Runner) logf(format string, args ...interface{}) {
+	if r.Logf == nil {
+		log.Printf(format, args...)
+		return
+	}
+	r.Logf(format, args...)
+}
+
+// Generate runs "kedge generate" on files
+func (r *Runner) Generate(ctx context.Context, files []string, env map[string]string, extraArgs ...string) (*KappResult, error) {
+	return r.Kapp(ctx, KappGenerate, files, env, extraArgs...)
+}
+
+// Kapp runs the kedge subcommand, e.g. KappGenerate, on files. The variables
+// in env are set for kedge on top of the environment of the process, and
+// expanded in the file paths along with it.
+func (r *Runner) Kapp(ctx context.Context, subcommand string, files []string, env map[string]string, extraArgs ...string) (*KappResult, error) {
+	var expanded []string
+	for _, file := range files {
+		expanded = append(expanded, expandEnv(file, env))
+	}
+	if subcommand == KappGenerate && r.GenerateCommand != "" {
+		return r.runGenerateCommand(ctx, expanded, nil, env, extraArgs)
+	}
+	args := []string{subcommand}
+	for _, file := range expanded {
+		args = append(args, "-f")
+		args = append(args, file)
+	}
+	args = append(args, extraArgs...)
+	return r.runKapp(ctx, args, nil, env)
+}
+
+// KappInput is like Kapp, but feeds input to "kedge <subcommand> -f -"
+// instead of reading files
+func (r *Runner) KappInput(ctx context.Context, subcommand string, input []byte, env map[string]string, extraArgs ...string) (*KappResult, error) {
+	if subcommand == KappGenerate && r.GenerateCommand != "" {
+		return r.runGenerateCommand(ctx, []string{"-"}, input, env, extraArgs)
+	}
+	args := append([]string{subcommand, "-f", "-"}, extraArgs...)
+	return r.runKapp(ctx, args, input, env)
+}
+
+// runGenerateCommand runs the GenerateCommand on files, "-" for input
+func (r *Runner) runGenerateCommand(ctx context.Context, files []string, input []byte, env map[string]string, extraArgs []string) (*KappResult, error) {
+	// not started, like a kedge that is not there
+	notRun := &KappResult{ExitCode: -1}
+	data := struct {
+		Files []string
+		Args  []string
+	}{files, extraArgs}
+	var args []string
+	for _, field := range templateFields(r.GenerateCommand) {
+		switch strings.Join(strings.Fields(field), "") {
+		case "{{.Files}}":
+			args = append(args, files...)
+			continue
+		case "{{.Args}}":
+			args = append(args, extraArgs...)
+			continue
+		}
+		tmpl, err := template.New("generate").Funcs(template.FuncMap{"join": strings.Join}).Parse(field)
+		if err != nil {
+			return notRun, errors.Wrap(err, "invalid generate command")
+		}
+		var arg bytes.Buffer
+		if err := tmpl.Execute(&arg, data); err != nil {
+			return notRun, errors.Wrap(err, "invalid generate command")
+		}
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return notRun, fmt.Errorf("generate command %q is empty", r.GenerateCommand)
+	}
+
+	result, err := runCommand(ctx, args[0], args[1:], input, env, r.kappTimeout())
+	if err != nil {
+		return result, fmt.Errorf("error running %q\n%s %s", strings.Join(args, " "), result.Stderr, err)
+	}
+	return result, nil
+}
+
+// templateFields splits a template on the spaces that are not inside {{ }}
+func templateFields(s string) []string {
+	var fields []string
+	var field bytes.Buffer
+	inAction := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			inAction = true
+		case strings.HasPrefix(s[i:], "}}"):
+			inAction = false
+		case !inAction && unicode.IsSpace(rune(s[i])):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteByte(s[i])
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+func (r *Runner) runKapp(ctx context.Context, args []string, input []byte, env map[string]string) (*KappResult, error) {
+	result, err := runCommand(ctx, r.KappLoc, args, input, env, r.kappTimeout())
+	if err != nil {
+		return result, fmt.Errorf("error running %q\n%s %s",
+			fmt.Sprintf("kapp %s", strings.Join(args, " ")),
+			result.Stderr, err)
+	}
+	return result, nil
+}
+
+// runCommand runs a command generating manifests, kedge or GenerateCommand,
+// for at most timeout. The processes it starts are killed along with it,
+// e.g. the kubectl "kedge apply" runs.
+func runCommand(ctx context.Context, bin string, args []string, input []byte, env map[string]string, timeout time.Duration) (*KappResult, error) {
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.Command(bin, args...)
+	cmd.Env = mergeEnv(os.Environ(), env)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	setProcessGroup(cmd)
+
+	var out, stdErr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stdErr
+
+	err := cmd.Start()
+	if err == nil {
+		// the output is read until every process holding it exits, so
+		// killing the command alone could leave Wait blocked
+		exited := make(chan struct{})
+		go func() {
+			select {
+			case <-cmdCtx.Done():
+				killProcessGroup(cmd)
+			case <-exited:
+			}
+		}()
+		err = cmd.Wait()
+		close(exited)
+	}
+	result := &KappResult{
+		Args:   args,
+		Stdout: out.Bytes(),
+		Stderr: stdErr.Bytes(),
+	}
+	if err != nil {
+		// -1 when kedge could not even be started
+		result.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		// the test or the suite giving up is not our timeout expiring
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if cmdCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("killed after not finishing within %v", timeout)
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+// Create creates the resources in input with "kubectl create", and returns
+// the ones created as kubectl names them, e.g. "deployment/web", also when it
+// fails midway
+func (r *Runner) Create(ctx context.Context, input []byte, namespace string) ([]string, error) {
+	return r.kubectl(ctx, "create", input, namespace)
+}
+
+// Apply is like Create but uses "kubectl apply", so it can be re-run over
+// the resources that are already there
+func (r *Runner) Apply(ctx context.Context, input []byte, namespace string) ([]string, error) {
+	return r.kubectl(ctx, "apply", input, namespace)
+}
+
+// Delete deletes the resources in input with "kubectl delete", and returns
+// the ones deleted as kubectl names them
+func (r *Runner) Delete(ctx context.Context, input []byte, namespace string) ([]string, error) {
+	return r.kubectl(ctx, "delete", input, namespace)
+}
+
+func (r *Runner) kubectl(ctx context.Context, verb string, input []byte, namespace string) ([]string, error) {
+	kubectlCtx, cancel := context.WithTimeout(ctx, r.kubectlTimeout())
+	defer cancel()
+
+	// now deploy using cmdline kubectl
+	args := append(append([]string{}, r.KubectlArgs...), "-n", namespace, verb, "-f", "-", "-o", "name")
+	kubectl := exec.CommandContext(kubectlCtx, r.KubectlLoc, args...)
+	// creating pipes needed
+	kIn, err := kubectl.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create the stdin pipe to kubectl")
+	}
+	writeErr := make(chan error, 1)
+	go func() {
+		defer kIn.Close()
+		_, err := kIn.Write(input)
+		writeErr <- err
+	}()
+
+	kOut, err := kubectl.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create the stdout pipe to kubectl")
+	}
+	kErr, err := kubectl.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create the stderr pipe to kubectl")
+	}
+	if err := kubectl.Start(); err != nil {
+		kIn.Close()
+		return nil, errors.Wrap(err, "cannot start kubectl")
+	}
+
+	// log the resources as kubectl gets to them, a large apply takes a while
+	var names []string
+	var stdErr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(kOut)
+		for scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				r.logf("kubectl %s in namespace %q: %s", verb, namespace, name)
+				names = append(names, name)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(kErr)
+		for scanner.Scan() {
+			r.logf("kubectl %s in namespace %q: %s", verb, namespace, scanner.Text())
+			stdErr.WriteString(scanner.Text() + "\n")
+		}
+	}()
+	// the pipes have to be read to the end before waiting
+	wg.Wait()
+	err = kubectl.Wait()
+
+	// kubectl exiting early breaks the pipe, its output tells why
+	if werr := <-writeErr; werr != nil {
+		return names, errors.Wrapf(werr, "cannot write to the stdin of kubectl (%v), got: %s", err, stdErr.String())
+	}
+	// the test or the suite giving up is not our timeout expiring
+	if err != nil && ctx.Err() != nil {
+		return names, ctx.Err()
+	}
+	if kubectlCtx.Err() == context.DeadlineExceeded {
+		return names, fmt.Errorf("kubectl %s killed after not finishing within %v, got: %s", verb, r.kubectlTimeout(), stdErr.String())
+	}
+	if err != nil {
+		return names, errors.Wrapf(err, "failed to execute, got: %s", stdErr.String())
+	}
+	return names, nil
+}
+
+// expandEnv is os.ExpandEnv, with the variables in env taking precedence
+func expandEnv(s string, env map[string]string) string {
+	return os.Expand(s, func(key string) string {
+		if value, ok := env[key]; ok {
+			return value
+		}
+		return os.Getenv(key)
+	})
+}
+
+// mergeEnv sets the variables in env on top of base, a list of key=value
+// pairs like os.Environ returns
+func mergeEnv(base []string, env map[string]string) []string {
+	var merged []string
+	for _, kv := range base {
+		if _, ok := env[strings.SplitN(kv, "=", 2)[0]]; !ok {
+			merged = append(merged, kv)
+		}
+	}
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		merged = append(merged, key+"="+env[key])
+	}
+	return merged
+}
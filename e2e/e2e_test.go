@@ -1,29 +1,112 @@
 package e2e
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/rand"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/apimachinery/pkg/watch"
 	v1 "k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	extensionsv1beta1 "k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
 var KappLoc string
 var KubectlLoc string
 var ProjectPath = "$GOPATH/src/github.com/kedgeproject/kedge/"
 
+var kubeconfig = flag.String("kubeconfig", defaultKubeconfig(), "(optional) absolute path to the kubeconfig file")
+var inCluster = flag.Bool("in-cluster", false, "use the service account of the pod the tests run in, the default when there is no kubeconfig in a pod")
+var kubeContext = flag.String("context", "", "kubeconfig context to use instead of the current one")
+var kubeApply = flag.Bool("apply", false, "deploy with kubectl apply instead of create, and reuse namespaces left over from earlier runs when used with -unique-namespaces=false")
+var uniqueNamespaces = flag.Bool("unique-namespaces", true, "add a random suffix to the namespace of every test, so suites can run side by side on a cluster")
+var nodeName = flag.String("node", "", "name of the node to reach NodePort services on, defaults to the first node")
+var addressTypes = flag.String("node-address-types", "ExternalIP,InternalIP", "comma separated node address types to reach NodePort services on, in order of preference, e.g. InternalIP,Hostname")
+var portForward = flag.Bool("port-forward", false, "reach the services through kubectl port-forward instead of the node ports, for clusters whose nodes are not reachable from where the tests run")
+var sequential = flag.Bool("sequential", false, "run the tests one at a time in the order they are declared, to reproduce failures that depend on the order")
+var concurrency = flag.Int("concurrency", defaultConcurrency(), "maximum number of tests run at the same time, also set with $E2E_CONCURRENCY")
+var junitOutput = flag.String("junit-output", "", "path to write a JUnit XML report of the tests to")
+var dryRunFlag = flag.Bool("dry-run", false, "only generate the manifests, without deploying them")
+var dryRunOutput = flag.String("dry-run-output", "", "directory to write the manifests of a dry run to, one file per test, instead of stdout")
+var keepOnFailure = flag.Bool("keep-on-failure", false, "do not delete the namespace of a failed test, to debug it")
+var kedgeBin = flag.String("kedge-bin", "", "path to the kedge binary to test, instead of the one on $PATH")
+var kubectlBin = flag.String("kubectl-bin", "", "path to the kubectl binary to deploy with, instead of the one on $PATH")
+var minKedgeVersion = flag.String("min-kedge-version", "", "fail unless kedge reports at least this version, e.g. 0.1.0")
+var minKubectlVersion = flag.String("min-kubectl-version", "", "fail unless kubectl reports at least this version, e.g. 1.7.0")
+var updateGolden = flag.Bool("update-golden", false, "write what kedge generates to the golden files of the tests, instead of comparing against them")
+var impersonateUser = flag.String("as", "", "user to run the tests as, e.g. a service account as system:serviceaccount:<namespace>:<name>, to check the manifests deploy with its permissions")
+var impersonateGroups = flag.String("as-group", "", "comma separated groups to run the tests as, along with -as")
+var clusterList = flag.String("clusters", "", "comma separated clusters to run every test on, each a context of -kubeconfig or a kubeconfig file, optionally followed by @context")
+var cleanupOnly = flag.Bool("cleanup", false, "only delete the namespaces earlier runs of the tests left behind, and exit")
+var minFreeCPU = flag.String("min-free-cpu", "", "hold back a test until the nodes have this much cpu no pod requests, e.g. 500m")
+var minFreeMemory = flag.String("min-free-memory", "", "hold back a test until the nodes have this much memory no pod requests, e.g. 512Mi")
+var suiteTimeout = flag.Duration("suite-timeout", 0, "stop the tests still running after this long, raise the go test -timeout above it")
+var clientQPS = flag.Float64("qps", 0, "queries per second the client may send to the API server, 0 for the client default")
+var clientBurst = flag.Int("burst", 0, "queries the client may send to the API server in a burst above -qps, 0 for the client default")
+var verifyCleanup = flag.Bool("verify-cleanup", false, "fail a test that leaves its namespace, persistent volumes or cluster scoped resources behind after deleting them")
+var retries = flag.Int("retries", 0, "run a failed test again up to this many times, in a fresh namespace, and only fail it when every attempt failed")
+var generateCommand = flag.String("generate-command", "", `command line template generating the manifests instead of kedge, to test another tool, e.g. 'kompose convert --stdout -f {{join .Files ","}}', see Runner.GenerateCommand`)
+var reportOutput = flag.String("report", "", "path to write a JSON summary of the run to, with the result and phase timings of every test")
+var cleanupUnlabeled = flag.Bool("cleanup-unlabeled", false, "with -cleanup, also delete the namespaces named like those of the tests that lack the created-by label, e.g. left behind by older versions of the tests")
+var testCases = flag.String("testcases", "", "file, or directory of files, with the test cases to run instead of the built-in ones")
+
+// PodStartTimeout is how long a test waits for its pods to be running
+var PodStartTimeout = 5 * time.Minute
+
+// PollInterval is how often the wait loops check on the cluster, and the
+// first delay between pings of an endpoint
+var PollInterval = 1 * time.Second
+
+func init() {
+	flag.DurationVar(&PollInterval, "poll-interval", PollInterval, "how often to check on the cluster while waiting, raise it on slow clusters")
+}
+
+// defaultConcurrency is 4 unless overridden with $E2E_CONCURRENCY
+func defaultConcurrency() int {
+	if n, err := strconv.Atoi(os.Getenv("E2E_CONCURRENCY")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
+
 func homeDir() string {
 	if h := os.Getenv("HOME"); h != "" {
 		return h
@@ -31,36 +114,214 @@ func homeDir() string {
 	return os.Getenv("USERPROFILE") // windows
 }
 
-func createClient() (*kubernetes.Clientset, error) {
-	var kubeconfig *string
+// useInClusterConfig tells if the client should be configured from within the
+// cluster, when asked to or when there is no kubeconfig but we run in a pod
+func useInClusterConfig(kubeconfig string) bool {
+	if *inCluster {
+		return true
+	}
+	if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	if kubeconfig == "" {
+		return true
+	}
+	_, err := os.Stat(kubeconfig)
+	return os.IsNotExist(err)
+}
+
+// defaultKubeconfig is ~/.kube/config, if there is a home directory
+func defaultKubeconfig() string {
 	if home := homeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+		return filepath.Join(home, ".kube", "config")
 	}
-	flag.Parse()
+	return ""
+}
 
-	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+// createClient connects to the cluster of kubeconfig, a qps or burst of zero
+// keeps the client default
+func createClient(kubeconfig, kubeContext string, impersonate rest.ImpersonationConfig, qps float32, burst int) (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+	if useInClusterConfig(kubeconfig) {
+		// running as a pod, use its service account
+		config, err = rest.InClusterConfig()
+	} else {
+		// use the current context in kubeconfig, unless another one is asked for
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+		).ClientConfig()
+	}
 	if err != nil {
-		panic(err.Error())
+		return nil, errors.Wrap(err, "cannot load the client config")
+	}
+	config.Impersonate = impersonate
+	// the client defaults throttle the waits of many tests at once
+	if qps > 0 {
+		config.QPS = qps
+	}
+	if burst > 0 {
+		config.Burst = burst
 	}
 
 	// create the clientset
 	return kubernetes.NewForConfig(config)
 }
 
-func createNS(clientset *kubernetes.Clientset, name string) (*v1.Namespace, error) {
+// checkConnection fails early, and clearly, when the cluster cannot be
+// reached, instead of deep in the first test
+func checkConnection(t *testing.T, clientset *kubernetes.Clientset) error {
+	info, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return errors.Wrapf(err, "cannot reach cluster at %s", clientset.Discovery().RESTClient().Get().URL().Host)
+	}
+	t.Logf("cluster at %s runs Kubernetes %s", clientset.Discovery().RESTClient().Get().URL().Host, info.GitVersion)
+	return nil
+}
+
+// Cluster is a cluster the tests run against
+type Cluster struct {
+	// Name tells the results on the cluster apart, empty when there is only
+	// the one cluster
+	Name       string
+	Kubeconfig string
+	Context    string
+	Clientset  *kubernetes.Clientset
+}
+
+// parseClusters reads the -clusters list. Each entry is a context of the
+// kubeconfig, or a kubeconfig file, optionally followed by @context. Contexts
+// often hold an @ themselves, e.g. "kubernetes-admin@kubernetes", so an entry
+// is only split on an @ when what comes before it is a file.
+func parseClusters(list, kubeconfig string) []Cluster {
+	var clusters []Cluster
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cluster := Cluster{Name: entry, Kubeconfig: kubeconfig, Context: entry}
+		if isFile(entry) {
+			cluster.Kubeconfig, cluster.Context = entry, ""
+		}
+		for i, c := range entry {
+			if c == '@' && isFile(entry[:i]) {
+				cluster.Kubeconfig, cluster.Context = entry[:i], entry[i+1:]
+				break
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// impersonation is who -as and -as-group ask the tests to act as
+func impersonation() rest.ImpersonationConfig {
+	config := rest.ImpersonationConfig{UserName: *impersonateUser}
+	for _, group := range strings.Split(*impersonateGroups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			config.Groups = append(config.Groups, group)
+		}
+	}
+	return config
+}
+
+// kubectlCommand runs kubectl against the cluster, as the same user the
+// client impersonates
+func kubectlCommand(ctx context.Context, cluster *Cluster, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, KubectlLoc, append(kubectlArgs(cluster), args...)...)
+}
+
+// kubectlArgs are the arguments kubectlCommand starts with
+func kubectlArgs(cluster *Cluster) []string {
+	impersonate := impersonation()
+	var global []string
+	if cluster.Kubeconfig != "" && !useInClusterConfig(cluster.Kubeconfig) {
+		global = append(global, "--kubeconfig", cluster.Kubeconfig)
+	}
+	if cluster.Context != "" {
+		global = append(global, "--context", cluster.Context)
+	}
+	if impersonate.UserName != "" {
+		global = append(global, "--as", impersonate.UserName)
+	}
+	for _, group := range impersonate.Groups {
+		global = append(global, "--as-group", group)
+	}
+	return global
+}
+
+// uniqueNamespace makes a namespace name, e.g. "wordpress-x7k2bq", that is not
+// used by any other run of the same test
+func uniqueNamespace(base string) string {
+	return fmt.Sprintf("%s-%s", base, rand.String(6))
+}
+
+// Labels put on every namespace the tests create, to find them again, e.g.
+// kubectl delete ns -l created-by=kedge-e2e
+const (
+	CreatedByLabel = "created-by"
+	CreatedBy      = "kedge-e2e"
+	RunIDLabel     = "run-id"
+)
+
+// RunID tells the namespaces of this run apart from those of other runs
+var RunID = rand.String(8)
+
+// createNS creates the namespace, waiting up to NamespaceDeleteTimeout for an
+// earlier namespace of the same name to finish terminating
+func createNS(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, name string) (*v1.Namespace, error) {
 	ns := &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
+			Labels: map[string]string{
+				CreatedByLabel: CreatedBy,
+				RunIDLabel:     RunID,
+			},
 		},
 	}
-	return clientset.CoreV1().Namespaces().Create(ns)
+
+	var created *v1.Namespace
+	var createErr error
+	err := waitFor(ctx, NamespaceDeleteTimeout, func() (bool, error) {
+		created, createErr = clientset.CoreV1().Namespaces().Create(ns)
+		if createErr == nil {
+			return true, nil
+		}
+		if !apierrors.IsAlreadyExists(createErr) && !apierrors.IsConflict(createErr) {
+			return false, createErr
+		}
+
+		old, err := clientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// deleted in the meantime, so creating it again can work
+			return false, nil
+		}
+		if err != nil || old.Status.Phase != v1.NamespaceTerminating {
+			return false, createErr
+		}
+		t.Logf("namespace %q is still terminating, waiting to create it again", name)
+		return false, nil
+	})
+	if err == errWaitTimeout {
+		return nil, errors.Wrapf(createErr, "namespace %q still there after %v", name, NamespaceDeleteTimeout)
+	}
+	return created, err
 }
 
+// FindKapp finds kedge on $PATH, or at -kedge-bin if it is set
 func FindKapp(t *testing.T) (string, error) {
-	kapp, err := exec.LookPath("kedge")
+	bin := "kedge"
+	if *kedgeBin != "" {
+		bin = *kedgeBin
+	}
+	kapp, err := exec.LookPath(bin)
 	if err != nil {
 		return "", errors.Wrap(err, "cannot find kapp")
 	}
@@ -68,8 +329,13 @@ func FindKapp(t *testing.T) (string, error) {
 	return kapp, nil
 }
 
+// FindKubectl finds kubectl on $PATH, or at -kubectl-bin if it is set
 func FindKubectl(t *testing.T) (string, error) {
-	kubectl, err := exec.LookPath("kubectl")
+	bin := "kubectl"
+	if *kubectlBin != "" {
+		bin = *kubectlBin
+	}
+	kubectl, err := exec.LookPath(bin)
 	if err != nil {
 		return "", errors.Wrap(err, "cannot find kubectl")
 	}
@@ -77,52 +343,321 @@ func FindKubectl(t *testing.T) (string, error) {
 	return kubectl, nil
 }
 
-func RunKapp(files []string) ([]byte, error) {
-	args := []string{"generate"}
-	for _, file := range files {
-		args = append(args, "-f")
-		args = append(args, os.ExpandEnv(file))
+// versionPattern finds the first x.y.z version in the output of a version
+// command, e.g. "1.7.0" in `GitVersion:"v1.7.0"`
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// CheckVersion logs the version bin reports when run with args, and checks
+// it is at least min, e.g. "1.7.0". An empty min only logs the version. bin is
+// killed if it runs for longer than timeout.
+func CheckVersion(t *testing.T, bin, min string, timeout time.Duration, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, bin, args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after not finishing within %v", timeout)
 	}
-	cmd := exec.Command(KappLoc, args...)
+	if err != nil {
+		err = errors.Wrapf(err, "cannot get the version of %s, got: %s", bin, string(output))
+		if min == "" {
+			t.Log(err)
+			return nil
+		}
+		return err
+	}
+	version := strings.TrimSpace(string(output))
+	t.Logf("%s version: %s", filepath.Base(bin), version)
+	if min == "" {
+		return nil
+	}
+
+	have, ok := parseVersion(version)
+	if !ok {
+		return fmt.Errorf("cannot find the version of %s in %q", bin, version)
+	}
+	want, ok := parseVersion(min)
+	if !ok {
+		return fmt.Errorf("invalid minimum version %q of %s", min, bin)
+	}
+	for i := range have {
+		if have[i] != want[i] {
+			if have[i] < want[i] {
+				return fmt.Errorf("%s version %d.%d.%d is older than %s", bin, have[0], have[1], have[2], min)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func parseVersion(s string) ([3]int, bool) {
+	var version [3]int
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return version, false
+	}
+	for i := range version {
+		version[i], _ = strconv.Atoi(m[i+1])
+	}
+	return version, true
+}
+
+// RunKapp runs the kedge subcommand, e.g. KappGenerate, on files. The
+// variables in env are set for kedge on top of the environment of the tests,
+// and expanded in the file paths along with it.
+func RunKapp(ctx context.Context, subcommand string, files []string, env map[string]string, extraArgs ...string) (*KappResult, error) {
+	return (&Runner{KappLoc: KappLoc, GenerateCommand: *generateCommand}).Kapp(ctx, subcommand, files, env, extraArgs...)
+}
+
+// RunKappInput is like RunKapp, but feeds input to "kedge <subcommand> -f -"
+// instead of reading files, e.g. for kedge files templated by the test
+func RunKappInput(ctx context.Context, subcommand string, input []byte, env map[string]string, extraArgs ...string) (*KappResult, error) {
+	return (&Runner{KappLoc: KappLoc, GenerateCommand: *generateCommand}).KappInput(ctx, subcommand, input, env, extraArgs...)
+}
+
+// ResourceID identifies a Kubernetes object
+type ResourceID struct {
+	schema.GroupVersionKind
+	Namespace string
+	Name      string
+}
+
+func (r ResourceID) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s %s/%s", r.GroupVersion(), r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s %s/%s/%s", r.GroupVersion(), r.Kind, r.Namespace, r.Name)
+}
+
+// ParseManifests splits the YAML documents generated by kedge into the
+// Kubernetes objects they define
+func ParseManifests(data []byte) ([]unstructured.Unstructured, error) {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	var objs []unstructured.Unstructured
+	// the documents read so far, to tell which one is wrong, as opposed to
+	// the objects found in them
+	docs := 0
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		docs++
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read document %d", docs)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+
+		jsonDoc, err := k8syaml.ToJSON(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse document %d", docs)
+		}
+		// a document of only comments
+		if bytes.Equal(bytes.TrimSpace(jsonDoc), []byte("null")) {
+			continue
+		}
+		var obj unstructured.Unstructured
+		if err := obj.UnmarshalJSON(jsonDoc); err != nil {
+			return nil, errors.Wrapf(err, "document %d is not a Kubernetes object", docs)
+		}
+		// a kind: List, as e.g. kompose prints, stands for its items
+		if obj.IsList() {
+			// the items are decoded one by one, UnstructuredList.Items
+			// holds pointers in some apimachinery versions and values in
+			// others
+			var list struct {
+				Items []json.RawMessage `json:"items"`
+			}
+			if err := json.Unmarshal(jsonDoc, &list); err != nil {
+				return nil, errors.Wrapf(err, "document %d is not a list of Kubernetes objects", docs)
+			}
+			for i, raw := range list.Items {
+				var item unstructured.Unstructured
+				if err := item.UnmarshalJSON(raw); err != nil {
+					return nil, errors.Wrapf(err, "item %d of document %d is not a Kubernetes object", i, docs)
+				}
+				objs = append(objs, item)
+			}
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// ResourceIDs identifies each of the objects
+func ResourceIDs(objs []unstructured.Unstructured) []ResourceID {
+	var ids []ResourceID
+	for _, obj := range objs {
+		ids = append(ids, ResourceID{
+			GroupVersionKind: obj.GroupVersionKind(),
+			Namespace:        obj.GetNamespace(),
+			Name:             obj.GetName(),
+		})
+	}
+	return ids
+}
+
+// kubectlRunner runs kubectl against the cluster, logging to the test
+func kubectlRunner(t *testing.T, cluster *Cluster) *Runner {
+	return &Runner{KubectlLoc: KubectlLoc, KubectlArgs: kubectlArgs(cluster), Logf: t.Logf}
+}
+
+// RunKubeCreate creates the resources in input, and returns the ones created
+// as kubectl names them, e.g. "deployment/web", also when it fails midway
+func RunKubeCreate(ctx context.Context, t *testing.T, cluster *Cluster, input []byte, namespace string) ([]string, error) {
+	return kubectlRunner(t, cluster).Create(ctx, input, namespace)
+}
+
+// RunKubeApply is like RunKubeCreate but uses "kubectl apply", so it can be
+// re-run over the resources that are already there
+func RunKubeApply(ctx context.Context, t *testing.T, cluster *Cluster, input []byte, namespace string) ([]string, error) {
+	return kubectlRunner(t, cluster).Apply(ctx, input, namespace)
+}
+
+// RunKubeDelete deletes the resources in input with "kubectl delete -f -",
+// and returns the ones deleted as kubectl names them
+func RunKubeDelete(ctx context.Context, t *testing.T, cluster *Cluster, input []byte, namespace string) ([]string, error) {
+	return kubectlRunner(t, cluster).Delete(ctx, input, namespace)
+}
 
-	var out, stdErr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stdErr
+// RunKubeWait runs "kubectl wait" with the given condition, e.g.
+// "--for=condition=Available deployment/web", for readiness the other
+// helpers do not cover
+func RunKubeWait(ctx context.Context, t *testing.T, cluster *Cluster, namespace, condition string, timeout time.Duration) error {
+	// let kubectl time out on its own, and tell us so
+	ctx, cancel := context.WithTimeout(ctx, timeout+30*time.Second)
+	defer cancel()
 
-	err := cmd.Run()
+	args := append([]string{"-n", namespace, "wait", "--timeout", timeout.String()}, strings.Fields(condition)...)
+	output, err := kubectlCommand(ctx, cluster, args...).CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("error running %q\n%s %s",
-			fmt.Sprintf("kapp %s", strings.Join(args, " ")),
-			stdErr.String(), err)
+		return errors.Wrapf(err, "kubectl wait %s failed, got: %s", condition, string(output))
 	}
-	return out.Bytes(), nil
+	t.Logf("kubectl wait %s:\n%s", condition, string(output))
+	return nil
+}
+
+// DeleteResources deletes the resources with the given kubectl names, e.g.
+// what RunKubeCreate returns, for when deleting the namespace would take
+// along more than the test created. Cluster scoped resources are deleted
+// with an empty namespace.
+func DeleteResources(ctx context.Context, t *testing.T, cluster *Cluster, namespace string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, KubectlTimeout)
+	defer cancel()
+
+	args := []string{"delete", "--ignore-not-found"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	args = append(args, names...)
+	output, err := kubectlCommand(ctx, cluster, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %v, got: %s", names, string(output))
+	}
+	t.Logf("deleted from namespace %q: %v", namespace, names)
+	return nil
 }
 
-func RunKubeCreate(t *testing.T, input []byte, namespace string) error {
-	// now deploy using cmdline kubectl
-	kubectl := exec.Command(KubectlLoc, "-n", namespace, "create", "-f", "-")
-	// creating pipes needed
-	kIn, err := kubectl.StdinPipe()
+// forwardingPattern finds the local address in the output of
+// "kubectl port-forward", e.g. "Forwarding from 127.0.0.1:34567 -> 80"
+var forwardingPattern = regexp.MustCompile(`Forwarding from (127\.0\.0\.1:\d+)`)
+
+// RunPortForward forwards a random local port to the port, a number or a
+// name, of the service with "kubectl port-forward", for clusters whose node
+// ports cannot be reached. It returns the local address, e.g.
+// "127.0.0.1:34567", and the func that stops forwarding.
+func RunPortForward(ctx context.Context, t *testing.T, cluster *Cluster, namespace, service, port string) (string, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+	kubectl := kubectlCommand(ctx, cluster, "-n", namespace, "port-forward", "svc/"+service, ":"+port)
+	kOut, err := kubectl.StdoutPipe()
 	if err != nil {
-		return errors.Wrap(err, "cannot create the stdin pipe to kubectl")
+		cancel()
+		return "", nil, errors.Wrap(err, "cannot create the stdout pipe to kubectl")
 	}
+	var stdErr bytes.Buffer
+	kubectl.Stderr = &stdErr
+	if err := kubectl.Start(); err != nil {
+		cancel()
+		return "", nil, errors.Wrap(err, "cannot start kubectl")
+	}
+	stop := func() {
+		cancel()
+		kubectl.Wait()
+	}
+
+	// kubectl keeps logging the connections it forwards, read it all
+	address := make(chan string, 1)
 	go func() {
-		defer kIn.Close()
-		kIn.Write(input)
-		//if _, err := kIn.Write(input); err != nil {
-		//	return errors.Wrap(err, "cannot write to the stdin of kubectl command")
-		//}
+		defer close(address)
+		scanner := bufio.NewScanner(kOut)
+		for scanner.Scan() {
+			if m := forwardingPattern.FindStringSubmatch(scanner.Text()); m != nil {
+				select {
+				case address <- m[1]:
+				default:
+				}
+			}
+		}
 	}()
 
-	output, err := kubectl.CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "failed to execute, got: %s", string(output))
+	select {
+	case a, ok := <-address:
+		if !ok {
+			stop()
+			return "", nil, fmt.Errorf("kubectl port-forward to service %q exited, got: %s", service, stdErr.String())
+		}
+		t.Logf("forwarding %s to service %q port %s", a, service, port)
+		return a, stop, nil
+	case <-time.After(KubectlTimeout):
+		stop()
+		return "", nil, fmt.Errorf("kubectl port-forward to service %q did not start within %v, got: %s", service, KubectlTimeout, stdErr.String())
 	}
-	t.Logf("deployed in namespace: %q\n%s", namespace, string(output))
-	return nil
 }
 
-func mapkeys(m map[string]int) []string {
+// ClusterScoped picks the objects that do not live in a namespace, and so are
+// left behind when the namespace of the test is deleted, as kubectl names
+// them, e.g. "clusterroles.rbac.authorization.k8s.io/admin"
+func ClusterScoped(clientset *kubernetes.Clientset, objs []unstructured.Unstructured) ([]string, error) {
+	resources := make(map[schema.GroupVersion]*metav1.APIResourceList)
+	var names []string
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		gv := gvk.GroupVersion()
+		list, ok := resources[gv]
+		if !ok {
+			var err error
+			list, err = clientset.Discovery().ServerResourcesForGroupVersion(gv.String())
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot discover the resources of %q", gv)
+			}
+			resources[gv] = list
+		}
+
+		for _, r := range list.APIResources {
+			// skip subresources like "deployments/scale"
+			if r.Kind != gvk.Kind || strings.Contains(r.Name, "/") {
+				continue
+			}
+			if !r.Namespaced {
+				resource := r.Name
+				if gv.Group != "" {
+					resource += "." + gv.Group
+				}
+				names = append(names, resource+"/"+obj.GetName())
+			}
+			break
+		}
+	}
+	return names, nil
+}
+
+func mapkeys(m map[string]PodTarget) []string {
 	var keys []string
 	for k := range m {
 		keys = append(keys, k)
@@ -130,130 +665,1903 @@ func mapkeys(m map[string]int) []string {
 	return keys
 }
 
-func PodsStarted(t *testing.T, clientset *kubernetes.Clientset, namespace string, podNames []string) error {
-	// convert podNames to map
-	podUp := make(map[string]int)
-	for _, p := range podNames {
-		podUp[p] = 0
-	}
+// listPods is the context aware version of clientset.CoreV1().Pods().List
+func listPods(ctx context.Context, clientset *kubernetes.Clientset, namespace string, opts metav1.ListOptions) (*v1.PodList, error) {
+	pods := &v1.PodList{}
+	err := clientset.CoreV1().RESTClient().Get().
+		Namespace(namespace).
+		Resource("pods").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Context(ctx).
+		Do().
+		Into(pods)
+	return pods, err
+}
 
-	for {
-		t.Logf("pods not started yet: %q", strings.Join(mapkeys(podUp), " "))
+// PodsStarted waits until as many running pods as its Replicas match every
+// target, in namespace or the Namespace of the target. The timeout is shared
+// by all the namespaces.
+func PodsStarted(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, targets []PodTarget, requireReady bool, timeout time.Duration) (PodStats, error) {
+	byNamespace := make(map[string][]PodTarget)
+	var namespaces []string
+	for _, target := range targets {
+		// the test cases from a file were checked when loaded, the built-in
+		// ones only get checked here
+		if err := target.compile(); err != nil {
+			return PodStats{}, err
+		}
+		ns := namespace
+		if target.Namespace != "" {
+			ns = target.Namespace
+		}
+		if _, ok := byNamespace[ns]; !ok {
+			namespaces = append(namespaces, ns)
+		}
+		byNamespace[ns] = append(byNamespace[ns], target)
+	}
 
-		pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	stats := PodStats{Restarts: make(map[string]int32)}
+	deadline := time.Now().Add(timeout)
+	for _, ns := range namespaces {
+		nsStats, err := podsStarted(ctx, t, clientset, ns, byNamespace[ns], requireReady, time.Until(deadline))
+		stats.Checks += nsStats.Checks
+		for pod, n := range nsStats.Restarts {
+			if ns != namespace {
+				pod = ns + "/" + pod
+			}
+			stats.Restarts[pod] = n
+		}
 		if err != nil {
-			return errors.Wrap(err, "error while listing all pods")
+			if ns != namespace {
+				err = errors.Wrapf(err, "namespace %q", ns)
+			}
+			return stats, err
 		}
-		// iterate on all pods we care about
-		for k := range podUp {
-			for _, p := range pods.Items {
-				if strings.Contains(p.Name, k) && p.Status.Phase == v1.PodRunning {
+	}
+	return stats, nil
+}
+
+// podsStarted is PodsStarted for the targets in a single namespace. It lists
+// the pods once and then follows the changes to them with a watch, listing
+// them again whenever the watch fails or is closed by the server.
+func podsStarted(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, targets []PodTarget, requireReady bool, timeout time.Duration) (PodStats, error) {
+	start := time.Now()
+	attempts := 0
+	// most restarts seen of a container of every matching pod
+	restarts := make(map[string]int32)
+	stats := func() PodStats {
+		return PodStats{Checks: attempts, Restarts: restarts}
+	}
+	// convert targets to map
+	podUp := make(map[string]PodTarget)
+	for _, p := range targets {
+		podUp[p.key()] = p
+	}
+	// last observed state of every pod we are still waiting on
+	lastSeen := make(map[string]string)
+	// the pods of every target that are up, for targets with Replicas
+	running := make(map[string]map[string]bool)
+	// set once a pod we wait on is found in a state it will not recover from
+	var failed error
+
+	// checks a pod against the targets we are still waiting on
+	observe := func(p v1.Pod) {
+		for k, target := range podUp {
+			if !target.matches(p) {
+				continue
+			}
+			if n := podRestarts(p); n > restarts[p.Name] {
+				restarts[p.Name] = n
+			}
+			if p.DeletionTimestamp == nil && p.Status.Phase == v1.PodRunning && (!requireReady || podReady(p)) {
+				if running[k] == nil {
+					running[k] = make(map[string]bool)
+				}
+				if !running[k][p.Name] {
 					t.Logf("Pod %q started!", p.Name)
-					delete(podUp, k)
+					if restarts[p.Name] > 0 {
+						t.Logf("warning: pod %q restarted %d times before it started, it may be unstable", p.Name, restarts[p.Name])
+					}
+					running[k][p.Name] = true
 				}
+				if len(running[k]) < target.replicas() {
+					lastSeen[k] = fmt.Sprintf("%d of %d pods started", len(running[k]), target.replicas())
+					continue
+				}
+				delete(podUp, k)
+				continue
+			}
+			// a pod that was up may have gone down again
+			delete(running[k], p.Name)
+			lastSeen[k] = podState(p)
+			if err := podFailure(p); err != nil && failed == nil {
+				failed = err
+			}
+		}
+	}
+	done := func() bool {
+		return len(podUp) == 0 || failed != nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for len(podUp) > 0 {
+		t.Logf("pods not started yet: %q", strings.Join(mapkeys(podUp), " "))
+
+		// the targets are matched on our side, a single label selector
+		// cannot cover targets matched by name and by different selectors
+		attempts++
+		var pods *v1.PodList
+		err := retryTransient(waitCtx, t, "listing pods", func() error {
+			var err error
+			pods, err = listPods(waitCtx, clientset, namespace, metav1.ListOptions{})
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return stats(), ctx.Err()
+			}
+			if waitCtx.Err() != nil {
+				return stats(), podsTimeoutError(timeout, podUp, lastSeen)
 			}
+			return stats(), errors.Wrap(err, "error while listing all pods")
+		}
+		for _, p := range pods.Items {
+			observe(p)
+		}
+		if failed != nil {
+			return stats(), failed
 		}
 		if len(podUp) == 0 {
 			break
 		}
-		time.Sleep(1 * time.Second)
+
+		w, err := clientset.CoreV1().Pods(namespace).Watch(metav1.ListOptions{
+			ResourceVersion: pods.ResourceVersion,
+		})
+		if err != nil {
+			t.Logf("error watching pods, listing them again: %v", err)
+		} else {
+			err = watchPods(waitCtx, w, func(p v1.Pod) {
+				attempts++
+				observe(p)
+			}, done)
+			w.Stop()
+			if failed != nil {
+				return stats(), failed
+			}
+			if err == nil {
+				break
+			}
+			if err != errWatchClosed {
+				t.Logf("error watching pods, listing them again: %v", err)
+			}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			// the caller gave up on us, as opposed to our own timeout expiring
+			if ctx.Err() != nil {
+				return stats(), ctx.Err()
+			}
+			return stats(), podsTimeoutError(timeout, podUp, lastSeen)
+		case <-time.After(PollInterval):
+		}
 	}
-	return nil
+	t.Logf("pods started after %v and %d checks", time.Since(start), attempts)
+	return stats(), nil
 }
 
-func getEndPoints(t *testing.T, clientset *kubernetes.Clientset, namespace string, svcs []ServicePort) (map[string]string, error) {
-	// find the minikube ip
-	node, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		return nil, errors.Wrap(err, "error while listing all nodes")
+// PodStats tells how PodsStarted went
+type PodStats struct {
+	// Checks is how many times the pods were checked, a list or a watch
+	// event each
+	Checks int
+	// Restarts is the most restarts of a container of every pod that
+	// matched a target, when there were any
+	Restarts map[string]int32
+}
+
+// podRestarts is the most restarts of a container of the pod
+func podRestarts(p v1.Pod) int32 {
+	var most int32
+	for _, s := range append(append([]v1.ContainerStatus{}, p.Status.InitContainerStatuses...), p.Status.ContainerStatuses...) {
+		if s.RestartCount > most {
+			most = s.RestartCount
+		}
 	}
-	nodeIP := node.Items[0].Status.Addresses[0].Address
-	t.Logf("node ip address %s", nodeIP)
+	return most
+}
 
-	// get all running services
-	runningSvcs, err := clientset.CoreV1().Services(namespace).List(metav1.ListOptions{})
-	if err != nil {
-		return nil, errors.Wrap(err, "error while listing all services")
+var errWatchClosed = fmt.Errorf("watch closed")
+
+// watchPods hands the pods added or modified to observe until done, or until
+// the watch ends, which is reported as an error so the pods get listed again
+func watchPods(ctx context.Context, w watch.Interface, observe func(v1.Pod), done func() bool) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return errWatchClosed
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				if p, ok := event.Object.(*v1.Pod); ok {
+					observe(*p)
+				}
+			case watch.Error:
+				return apierrors.FromObject(event.Object)
+			}
+			if done() {
+				return nil
+			}
+		}
 	}
+}
 
-	endpoint := make(map[string]string)
-	for _, svc := range svcs {
-		for _, s := range runningSvcs.Items {
-			if s.Name == svc.Name {
-				for _, p := range s.Spec.Ports {
-					if p.Port == svc.Port {
-						port := p.NodePort
-						v := fmt.Sprintf("http://%s:%d", nodeIP, port)
-						k := fmt.Sprintf("%s:%d", svc.Name, svc.Port)
-						endpoint[k] = v
-					}
+// imagePullFailures are the reasons a container waits with when its image
+// cannot be pulled
+var imagePullFailures = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+}
+
+// CrashLoopRestarts is how many times a crash looping container may restart
+// before its pod is given up on
+var CrashLoopRestarts int32 = 3
+
+// podFailure tells why the pod will not start without being fixed, or nil if
+// it may still start
+func podFailure(p v1.Pod) error {
+	var statuses []v1.ContainerStatus
+	statuses = append(statuses, p.Status.InitContainerStatuses...)
+	statuses = append(statuses, p.Status.ContainerStatuses...)
+	for _, c := range statuses {
+		waiting := c.State.Waiting
+		if waiting != nil && imagePullFailures[waiting.Reason] {
+			return fmt.Errorf("pod %q cannot pull image %q of container %q: %s: %s",
+				p.Name, c.Image, c.Name, waiting.Reason, waiting.Message)
+		}
+		if waiting != nil && waiting.Reason == "CrashLoopBackOff" && c.RestartCount >= CrashLoopRestarts {
+			last := "unknown"
+			if term := c.LastTerminationState.Terminated; term != nil {
+				last = fmt.Sprintf("%s with exit code %d", term.Reason, term.ExitCode)
+				if term.Message != "" {
+					last += ": " + term.Message
 				}
 			}
+			return fmt.Errorf("container %q of pod %q is crash looping after %d restarts, last terminated: %s",
+				c.Name, p.Name, c.RestartCount, last)
+		}
+	}
+	return nil
+}
+
+// podReady tells if the pod reports the Ready condition, i.e. its readiness
+// probes are passing
+func podReady(p v1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podState describes the pod phase, along with the reason the first waiting
+// container gives, e.g. "Running/CrashLoopBackOff"
+func podState(p v1.Pod) string {
+	state := string(p.Status.Phase)
+	for _, c := range p.Status.ContainerStatuses {
+		if c.State.Waiting != nil && c.State.Waiting.Reason != "" {
+			return state + "/" + c.State.Waiting.Reason
+		}
+	}
+	return state
+}
+
+func podsTimeoutError(timeout time.Duration, podUp map[string]PodTarget, lastSeen map[string]string) error {
+	pending := make(map[string]string)
+	for name := range podUp {
+		state, ok := lastSeen[name]
+		if !ok {
+			state = "not found"
+		}
+		pending[name] = state
+	}
+	return waitingTimeoutError(timeout, "pods", pending)
+}
+
+// DeploymentsAvailable waits until every named deployment has rolled out
+// and all of its replicas are available. Unlike PodsStarted it does not
+// depend on the generated pod names, so it holds across rollouts.
+func DeploymentsAvailable(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, names []string, timeout time.Duration) error {
+	return controllersReady(ctx, t, "deployment", names, timeout, func(name string) (bool, string, error) {
+		d, err := clientset.AppsV1beta1().Deployments(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		return deploymentAvailable(d), fmt.Sprintf("%d/%d available", d.Status.AvailableReplicas, d.Status.Replicas), nil
+	})
+}
+
+// StatefulSetsReady waits until every named statefulset runs all of its
+// replicas, and their pods are ready
+func StatefulSetsReady(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, names []string, timeout time.Duration) error {
+	return controllersReady(ctx, t, "statefulset", names, timeout, func(name string) (bool, string, error) {
+		ss, err := clientset.AppsV1beta1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		desired := int32(1)
+		if ss.Spec.Replicas != nil {
+			desired = *ss.Spec.Replicas
+		}
+		if ss.Status.ObservedGeneration == nil || *ss.Status.ObservedGeneration < ss.Generation || ss.Status.Replicas != desired {
+			return false, fmt.Sprintf("%d/%d replicas", ss.Status.Replicas, desired), nil
+		}
+
+		// this API version has no readyReplicas in the status, so count
+		// the ready pods ourselves
+		selector, err := metav1.LabelSelectorAsSelector(ss.Spec.Selector)
+		if err != nil {
+			return false, "", errors.Wrapf(err, "invalid selector of statefulset %q", name)
+		}
+		pods, err := listPods(ctx, clientset, namespace, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return false, "", err
+		}
+		var ready int32
+		for _, p := range pods.Items {
+			if podReady(p) {
+				ready++
+			}
+		}
+		return ready == desired, fmt.Sprintf("%d/%d ready", ready, desired), nil
+	})
+}
+
+// DaemonSetsReady waits until every named daemonset has a ready pod on all
+// the nodes it is scheduled to
+func DaemonSetsReady(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, names []string, timeout time.Duration) error {
+	return controllersReady(ctx, t, "daemonset", names, timeout, func(name string) (bool, string, error) {
+		ds, err := clientset.ExtensionsV1beta1().DaemonSets(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		ready := ds.Status.ObservedGeneration >= ds.Generation &&
+			ds.Status.NumberReady == ds.Status.DesiredNumberScheduled
+		return ready, fmt.Sprintf("%d/%d ready", ds.Status.NumberReady, ds.Status.DesiredNumberScheduled), nil
+	})
+}
+
+// JobBackoffLimit is how many failed pods a job may have before it is given
+// up on, the same as the default backoffLimit of newer clusters
+var JobBackoffLimit int32 = 6
+
+// JobsComplete waits until every named job has succeeded, and fails as soon
+// as one fails more than JobBackoffLimit times
+func JobsComplete(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, names []string, timeout time.Duration) error {
+	return controllersReady(ctx, t, "job", names, timeout, func(name string) (bool, string, error) {
+		job, err := clientset.BatchV1().Jobs(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		for _, c := range job.Status.Conditions {
+			if c.Type == batchv1.JobFailed && c.Status == v1.ConditionTrue {
+				return false, "", fmt.Errorf("failed: %s: %s", c.Reason, c.Message)
+			}
+		}
+		if job.Status.Failed > JobBackoffLimit {
+			return false, "", fmt.Errorf("failed %d times, more than the backoff limit of %d", job.Status.Failed, JobBackoffLimit)
+		}
+
+		completions := int32(1)
+		if job.Spec.Completions != nil {
+			completions = *job.Spec.Completions
+		}
+		state := fmt.Sprintf("%d/%d succeeded, %d failed", job.Status.Succeeded, completions, job.Status.Failed)
+		return job.Status.Succeeded >= completions, state, nil
+	})
+}
+
+// PVCBindTimeout is how long PVCsBound waits for the claims to be bound,
+// shorter than PodStartTimeout to tell storage problems from pod ones
+var PVCBindTimeout = 2 * time.Minute
+
+// PVCsBound waits until every named persistent volume claim is bound, and
+// fails as soon as provisioning a volume for one fails. A claim pending for
+// too long is reported with its latest event, e.g. that there is no storage
+// class.
+func PVCsBound(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, names []string, timeout time.Duration) error {
+	return controllersReady(ctx, t, "persistent volume claim", names, timeout, func(name string) (bool, string, error) {
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		if pvc.Status.Phase == v1.ClaimBound {
+			return true, "", nil
+		}
+		if pvc.Status.Phase == v1.ClaimLost {
+			return false, "", fmt.Errorf("lost its volume %q", pvc.Spec.VolumeName)
+		}
+
+		state := string(pvc.Status.Phase)
+		events, err := clientset.CoreV1().Events(namespace).List(metav1.ListOptions{
+			FieldSelector: "involvedObject.kind=PersistentVolumeClaim,involvedObject.name=" + name,
+		})
+		if err != nil {
+			return false, "", errors.Wrap(err, "error listing events")
+		}
+		var latest *v1.Event
+		for i, e := range events.Items {
+			if latest == nil || latest.LastTimestamp.Before(e.LastTimestamp) {
+				latest = &events.Items[i]
+			}
+		}
+		if latest != nil {
+			if latest.Reason == "ProvisioningFailed" {
+				return false, "", fmt.Errorf("%s: %s", latest.Reason, latest.Message)
+			}
+			state += fmt.Sprintf(", %s: %s", latest.Reason, latest.Message)
+		}
+		return false, state, nil
+	})
+}
+
+// controllersReady waits until check reports every named controller of kind
+// ready. Controllers that do not exist yet are waited on as well.
+func controllersReady(ctx context.Context, t *testing.T, kind string, names []string, timeout time.Duration, check func(name string) (bool, string, error)) error {
+	pending := make(map[string]string)
+	for _, name := range names {
+		pending[name] = "not found"
+	}
+
+	err := waitFor(ctx, timeout, func() (bool, error) {
+		for name := range pending {
+			ready, state, err := check(name)
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return false, errors.Wrapf(err, "%s %q", kind, name)
+			}
+			if ready {
+				t.Logf("%s %q ready!", strings.Title(kind), name)
+				delete(pending, name)
+				continue
+			}
+			pending[name] = state
+		}
+		return len(pending) == 0, nil
+	})
+	if err == errWaitTimeout {
+		return waitingTimeoutError(timeout, kind+"s", pending)
+	}
+	return err
+}
+
+// deploymentAvailable tells if the deployment controller has caught up with
+// the latest spec, and every replica it runs is available
+func deploymentAvailable(d *appsv1beta1.Deployment) bool {
+	if d.Status.ObservedGeneration < d.Generation {
+		return false
+	}
+	if d.Spec.Replicas != nil && d.Status.UpdatedReplicas < *d.Spec.Replicas {
+		return false
+	}
+	return d.Status.AvailableReplicas == d.Status.Replicas
+}
+
+// waitingTimeoutError lists the objects of kind still pending, along with
+// their last seen state
+func waitingTimeoutError(timeout time.Duration, kind string, pending map[string]string) error {
+	var names []string
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var states []string
+	for _, name := range names {
+		states = append(states, fmt.Sprintf("%s (%s)", name, pending[name]))
+	}
+	return fmt.Errorf("timed out after %v waiting for %s: %s",
+		timeout, kind, strings.Join(states, ", "))
+}
+
+// nodeAddress picks the address NodePort services are reached on, from the
+// node called name or the first node if name is empty. The first of the
+// address types the node has is used.
+func nodeAddress(nodes []v1.Node, name string, types []v1.NodeAddressType) (string, error) {
+	if len(nodes) == 0 {
+		return "", fmt.Errorf("no nodes found in the cluster")
+	}
+	node := &nodes[0]
+	if name != "" {
+		node = nil
+		for i := range nodes {
+			if nodes[i].Name == name {
+				node = &nodes[i]
+				break
+			}
+		}
+		if node == nil {
+			return "", fmt.Errorf("node %q not found", name)
+		}
+	}
+
+	if len(node.Status.Addresses) == 0 {
+		return "", fmt.Errorf("node %q has no addresses", node.Name)
+	}
+	for _, addrType := range types {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == addrType {
+				return addr.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("node %q has none of the address types %v", node.Name, types)
+}
+
+// nodeAddressTypes reads the -node-address-types list
+func nodeAddressTypes(list string) []v1.NodeAddressType {
+	var types []v1.NodeAddressType
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, v1.NodeAddressType(t))
+		}
+	}
+	return types
+}
+
+// endPoint is a resolved URL of a service, along with what the service was
+// asked to be checked for
+type endPoint struct {
+	ServicePort
+	URL string
+	// Host is sent instead of the host in URL, for services reached through
+	// an ingress
+	Host string
+}
+
+// EndPointTimeout is how long getEndPoints waits for the services to be exposed
+var EndPointTimeout = 5 * time.Minute
+
+func getEndPoints(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, namespace string, svcs []ServicePort) (map[string]endPoint, error) {
+	// find the ip of the node, on minikube the only one there is
+	node, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error while listing all nodes")
+	}
+	nodeIP, err := nodeAddress(node.Items, *nodeName, nodeAddressTypes(*addressTypes))
+	if err != nil {
+		return nil, err
+	}
+	t.Logf("node ip address %s", nodeIP)
+
+	endpoint := make(map[string]endPoint)
+	// what every service port not resolved yet is waiting for
+	pending := make(map[string]string)
+	for _, svc := range svcs {
+		pending[svc.key()] = "service not found"
+	}
+	err = waitFor(ctx, EndPointTimeout, func() (bool, error) {
+		// get all running services
+		runningSvcs, err := clientset.CoreV1().Services(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return false, errors.Wrap(err, "error while listing all services")
+		}
+
+		for _, svc := range svcs {
+			k := svc.key()
+			if _, ok := pending[k]; !ok {
+				continue
+			}
+			if svc.Ingress != "" {
+				e, err := ingressEndPoint(clientset, namespace, svc)
+				if err != nil {
+					return false, err
+				}
+				if e == nil {
+					pending[k] = fmt.Sprintf("ingress %q has no address", svc.Ingress)
+					continue
+				}
+				endpoint[k] = *e
+				delete(pending, k)
+				continue
+			}
+
+			e, reason, err := serviceEndPoint(runningSvcs.Items, svc, nodeIP)
+			if err != nil {
+				return false, err
+			}
+			if e == nil {
+				// the service controller, or the cloud load balancer,
+				// is not done yet
+				pending[k] = reason
+				continue
+			}
+			endpoint[k] = *e
+			delete(pending, k)
+		}
+		return len(pending) == 0, nil
+	})
+	if err == errWaitTimeout {
+		return nil, waitingTimeoutError(EndPointTimeout, "service ports", pending)
+	} else if err != nil {
+		return nil, err
+	}
+	logEndPoints(t, endpoint)
+	return endpoint, nil
+}
+
+// portForwardEndPoints is getEndPoints for -port-forward, reaching every
+// service port through a port forward of its own. The returned func stops
+// forwarding.
+func portForwardEndPoints(ctx context.Context, t *testing.T, cluster *Cluster, namespace string, svcs []ServicePort) (map[string]endPoint, func(), error) {
+	endpoint := make(map[string]endPoint)
+	var stops []func()
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+	for _, svc := range svcs {
+		if svc.Ingress != "" {
+			stopAll()
+			return nil, nil, fmt.Errorf("service port %q is reached through ingress %q, which cannot be port forwarded", svc.key(), svc.Ingress)
+		}
+		port := strconv.Itoa(int(svc.Port))
+		if svc.PortName != "" {
+			port = svc.PortName
+		}
+		address, stop, err := RunPortForward(ctx, t, cluster, namespace, svc.Name, port)
+		if err != nil {
+			stopAll()
+			return nil, nil, err
+		}
+		stops = append(stops, stop)
+
+		v := fmt.Sprintf("%s://%s%s", svc.scheme(), address, svc.path())
+		if svc.Protocol == ProtocolTCP {
+			v = address
+		}
+		endpoint[svc.key()] = endPoint{ServicePort: svc, URL: v}
+	}
+	logEndPoints(t, endpoint)
+	return endpoint, stopAll, nil
+}
+
+// matchReadinessProbes sets the Path of the service ports that ask for it to
+// the path of their readiness probe, see MatchReadinessProbe
+func matchReadinessProbes(clientset *kubernetes.Clientset, namespace string, svcs []ServicePort) ([]ServicePort, error) {
+	var matched []ServicePort
+	for _, svc := range svcs {
+		if svc.MatchReadinessProbe {
+			path, err := readinessProbePath(clientset, namespace, svc)
+			if err != nil {
+				return nil, err
+			}
+			if svc.Path != "" && svc.path() != path {
+				return nil, fmt.Errorf("service port %q pings %q, but its readiness probe checks %q", svc.key(), svc.path(), path)
+			}
+			svc.Path = path
+		}
+		matched = append(matched, svc)
+	}
+	return matched, nil
+}
+
+// readinessProbePath is the path of the HTTP readiness probe on the target
+// port of the service port, in the pods behind the service
+func readinessProbePath(clientset *kubernetes.Clientset, namespace string, svc ServicePort) (string, error) {
+	s, err := clientset.CoreV1().Services(namespace).Get(svc.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting service %q", svc.Name)
+	}
+	var target *intstr.IntOrString
+	for _, p := range s.Spec.Ports {
+		if svc.matches(p) {
+			target = &p.TargetPort
+			if target.Type == intstr.Int && target.IntVal == 0 {
+				// the target port defaults to the port
+				target = &intstr.IntOrString{IntVal: p.Port}
+			}
+			break
+		}
+	}
+	if target == nil {
+		return "", fmt.Errorf("service %q has no port %s", svc.Name, strings.TrimPrefix(svc.key(), svc.Name+":"))
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(s.Spec.Selector).String(),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "error listing the pods of service %q", svc.Name)
+	}
+	for _, p := range pods.Items {
+		for _, c := range p.Spec.Containers {
+			if c.ReadinessProbe == nil || c.ReadinessProbe.HTTPGet == nil {
+				continue
+			}
+			port := containerPort(c, *target)
+			if port != 0 && containerPort(c, c.ReadinessProbe.HTTPGet.Port) == port {
+				return c.ReadinessProbe.HTTPGet.Path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no pod of service %q has an HTTP readiness probe on port %s", svc.Name, target.String())
+}
+
+// containerPort resolves a port of the container given by its name, 0 when
+// the container has no port of that name
+func containerPort(c v1.Container, port intstr.IntOrString) int32 {
+	if port.Type == intstr.Int {
+		return port.IntVal
+	}
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
+
+// logEndPoints logs the URL of every service port, but not the rest of the
+// ServicePort, which may hold credentials
+func logEndPoints(t *testing.T, endpoint map[string]endPoint) {
+	urls := make(map[string]string)
+	for k, e := range endpoint {
+		urls[k] = e.URL
+	}
+	t.Logf("endpoints: %v", urls)
+}
+
+// serviceEndPoint resolves the URL of the service port among services, on
+// the node port or the load balancer. It is nil, along with the reason, until
+// the service exists and has its port assigned. A service port that will not
+// be reachable this way is an error.
+func serviceEndPoint(services []v1.Service, svc ServicePort, nodeIP string) (*endPoint, string, error) {
+	for _, s := range services {
+		if s.Name != svc.Name {
+			continue
+		}
+		for _, p := range s.Spec.Ports {
+			if !svc.matches(p) {
+				continue
+			}
+
+			host, port := nodeIP, p.NodePort
+			switch s.Spec.Type {
+			case v1.ServiceTypeLoadBalancer:
+				host, port = loadBalancerHost(s.Status.LoadBalancer), p.Port
+				if host == "" {
+					return nil, "waiting for load balancer", nil
+				}
+			case v1.ServiceTypeNodePort:
+				if port == 0 {
+					return nil, "no node port assigned", nil
+				}
+			default:
+				return nil, "", fmt.Errorf("service %q is of type %s, it has no node port", s.Name, s.Spec.Type)
+			}
+
+			v := fmt.Sprintf("%s://%s:%d%s", svc.scheme(), host, port, svc.path())
+			if svc.Protocol == ProtocolTCP {
+				v = net.JoinHostPort(host, strconv.Itoa(int(port)))
+			}
+			return &endPoint{ServicePort: svc, URL: v}, "", nil
+		}
+		return nil, "", fmt.Errorf("service %q has no port %s", s.Name, strings.TrimPrefix(svc.key(), svc.Name+":"))
+	}
+	return nil, "service not found", nil
+}
+
+// loadBalancerHost is the IP, or the hostname, a load balancer service or an
+// ingress is exposed on, empty while it is still being provisioned
+func loadBalancerHost(status v1.LoadBalancerStatus) string {
+	for _, ingress := range status.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP
+		}
+		if ingress.Hostname != "" {
+			return ingress.Hostname
+		}
+	}
+	return ""
+}
+
+// ingressEndPoint resolves the URL of the service through the ingress the
+// service port names, nil while the ingress or its address is not there yet.
+// The host of the matching rule is sent in the Host header, and its path is
+// requested unless the service port has a Path of its own.
+func ingressEndPoint(clientset *kubernetes.Clientset, namespace string, svc ServicePort) (*endPoint, error) {
+	ing, err := clientset.ExtensionsV1beta1().Ingresses(namespace).Get(svc.Ingress, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting ingress %q", svc.Ingress)
+	}
+
+	host, path, ok := ingressRoute(ing, svc)
+	if !ok {
+		return nil, fmt.Errorf("ingress %q does not route to service %q port %d", svc.Ingress, svc.Name, svc.Port)
+	}
+	address := loadBalancerHost(ing.Status.LoadBalancer)
+	if address == "" {
+		return nil, nil
+	}
+	if svc.Path != "" || path == "" {
+		path = svc.path()
+	}
+	return &endPoint{
+		ServicePort: svc,
+		URL:         fmt.Sprintf("%s://%s%s", svc.scheme(), address, path),
+		Host:        host,
+	}, nil
+}
+
+// ingressRoute finds the host and path the ingress routes to the service
+// port on. Backends naming the service port instead of its number match the
+// PortName, or any port of the service when it is not set.
+func ingressRoute(ing *extensionsv1beta1.Ingress, svc ServicePort) (string, string, bool) {
+	matches := func(b extensionsv1beta1.IngressBackend) bool {
+		if b.ServiceName != svc.Name {
+			return false
+		}
+		if b.ServicePort.Type == intstr.String {
+			return svc.PortName == "" || b.ServicePort.StrVal == svc.PortName
+		}
+		return b.ServicePort.IntVal == svc.Port
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if matches(p.Backend) {
+				return rule.Host, p.Path, true
+			}
+		}
+	}
+	if ing.Spec.Backend != nil && matches(*ing.Spec.Backend) {
+		return "", "", true
+	}
+	return "", "", false
+}
+
+// PingTimeout is how long pingEndPoints retries the services before failing
+var PingTimeout = 5 * time.Minute
+
+// maxBackoff caps the delay between two pings of a service
+const maxBackoff = 30 * time.Second
+
+// backoff is the delay before retrying after the given failed attempt, starting
+// at PollInterval and doubling up to maxBackoff, with up to 50% jitter on top
+func backoff(attempt int) time.Duration {
+	d := PollInterval << uint(attempt)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	// too short to jitter
+	if d/2 == 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63nRange(0, int64(d/2)))
+}
+
+// RetryBudget is how many times a transient error, see retryable, is retried
+// before it fails the test
+var RetryBudget = 3
+
+// fatalError marks an error retrying will not fix, that would otherwise look
+// transient
+type fatalError struct {
+	error
+}
+
+// transientErrors are found in the errors of requests that may succeed when
+// sent again, including the output of kubectl
+var transientErrors = []string{
+	"connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"the server is currently unable to handle the request",
+	"Internal error occurred",
+	"etcdserver: request timed out",
+}
+
+// retryable tells transient errors, e.g. an API server that is restarting,
+// from fatal ones, e.g. a request RBAC forbids, that fail the same way again
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if _, ok := cause.(fatalError); ok {
+		return false
+	}
+	switch {
+	case apierrors.IsForbidden(cause), apierrors.IsUnauthorized(cause),
+		apierrors.IsNotFound(cause), apierrors.IsAlreadyExists(cause),
+		apierrors.IsInvalid(cause), apierrors.IsBadRequest(cause):
+		return false
+	case apierrors.IsServerTimeout(cause), apierrors.IsTimeout(cause),
+		apierrors.IsInternalError(cause), apierrors.IsTooManyRequests(cause),
+		apierrors.IsUnexpectedServerError(cause):
+		return true
+	}
+	for _, transient := range transientErrors {
+		if strings.Contains(err.Error(), transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient runs f until it succeeds, fails with an error that is not
+// retryable, or has been retried RetryBudget times, backing off in between
+func retryTransient(ctx context.Context, t *testing.T, what string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || attempt >= RetryBudget {
+			return err
+		}
+		t.Logf("transient error %s, retrying: %v", what, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff(attempt)):
+		}
+	}
+}
+
+// pingEndPoints pings all the services concurrently, until they all respond
+// as expected or PingTimeout expires. It returns how pinging each of them
+// went, in the order of their names, along with the error failing the test.
+func pingEndPoints(ctx context.Context, t *testing.T, ep map[string]endPoint) ([]EndpointResult, error) {
+	pingCtx, cancel := context.WithTimeout(ctx, PingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []EndpointResult
+	for e, u := range ep {
+		wg.Add(1)
+		go func(e string, u endPoint) {
+			defer wg.Done()
+			result := pingEndPoint(pingCtx, t, e, u)
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(e, u)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	if ctx.Err() != nil {
+		return results, ctx.Err()
+	}
+	// why each of the failed services is not up
+	lastErr := make(map[string]error)
+	attempts := 0
+	for _, r := range results {
+		attempts += r.Attempts
+		if r.Err == nil {
+			continue
+		}
+		lastErr[r.Name] = r.Err
+		// the service kept failing until the deadline, as opposed to
+		// failing in a way retrying does not fix
+		if _, ok := errors.Cause(r.Err).(fatalError); !ok && pingCtx.Err() == context.DeadlineExceeded {
+			lastErr[r.Name] = fmt.Errorf("timeout after %v, last error: %v", PingTimeout, r.Err)
+		}
+	}
+	if len(lastErr) > 0 {
+		return results, pingError(lastErr)
+	}
+	t.Logf("services up after %v and %d pings", time.Since(start), attempts)
+	return results, nil
+}
+
+// pingEndPoint retries the service until it responds as expected, returning
+// the last error seen when ctx is done
+func pingEndPoint(ctx context.Context, t *testing.T, e string, u endPoint) EndpointResult {
+	result := EndpointResult{Name: e, URL: u.URL}
+	start := time.Now()
+	// the same client for every ping, so its connections are reused
+	client := u.client()
+	if transport, ok := client.Transport.(*http.Transport); ok && client.Transport != HTTPTransport {
+		defer transport.CloseIdleConnections()
+	}
+	// pings responded to as expected in a row, and failed in a row
+	successes, failures := 0, 0
+	for attempt := 0; ; attempt++ {
+		pingStart := time.Now()
+		status, lastErr := checkEndPoint(ctx, client, u)
+		result.StatusCode, result.Latency, result.Attempts = status, time.Since(pingStart), attempt+1
+		delay := PollInterval
+		if lastErr == nil {
+			successes, failures = successes+1, 0
+			if successes >= u.requiredSuccesses() {
+				t.Logf("%q is running! (%d pings in %v)", e, attempt+1, time.Since(start))
+				return result
+			}
+			t.Logf("service %q responded %d of %d times in a row", e, successes, u.requiredSuccesses())
+			// what is reported when ctx is done before the next ping
+			lastErr = fmt.Errorf("responded only %d of %d times in a row", successes, u.requiredSuccesses())
+		} else {
+			if _, ok := errors.Cause(lastErr).(fatalError); ok {
+				result.Err = lastErr
+				return result
+			}
+			t.Logf("service %q not up yet: %v", e, lastErr)
+			delay = backoff(failures)
+			successes, failures = 0, failures+1
+		}
+
+		select {
+		case <-ctx.Done():
+			result.Err = lastErr
+			return result
+		case <-time.After(delay):
+		}
+	}
+}
+
+// checkEndPoint tells why the service is not up yet, nil when it is, along
+// with the status it responded with. client makes the HTTP requests.
+func checkEndPoint(ctx context.Context, client *http.Client, u endPoint) (int, error) {
+	if u.Protocol == ProtocolTCP {
+		dialer := net.Dialer{Timeout: u.timeout()}
+		conn, err := dialer.DialContext(ctx, "tcp", u.URL)
+		if err != nil {
+			return 0, err
+		}
+		return 0, conn.Close()
+	}
+
+	var body io.Reader
+	if u.Body != "" {
+		body = strings.NewReader(u.Body)
+	}
+	req, err := http.NewRequest(u.method(), u.URL, body)
+	if err != nil {
+		return 0, fatalError{errors.Wrap(err, "cannot create request")}
+	}
+	if u.Host != "" {
+		req.Host = u.Host
+	}
+	if u.Username != "" {
+		req.SetBasicAuth(os.ExpandEnv(u.Username), os.ExpandEnv(u.Password))
+	}
+	if u.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(u.BearerToken))
+	}
+	for key, value := range u.Headers {
+		req.Header.Set(key, value)
+	}
+	// Go sends req.Host, not a Host header
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	respose, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		err = errors.Wrapf(err, "error while making http request %q", u.URL)
+		// a certificate the service presents will not become valid
+		if strings.Contains(err.Error(), "x509: ") {
+			return 0, fatalError{err}
+		}
+		return 0, err
+	}
+	defer respose.Body.Close()
+	if respose.StatusCode != u.expectStatus() {
+		if location := respose.Header.Get("Location"); u.DisableRedirects && location != "" {
+			return respose.StatusCode, fmt.Errorf("got %q redirecting to %q, expected %d", respose.Status, location, u.expectStatus())
+		}
+		// the service might still be warming up
+		return respose.StatusCode, fmt.Errorf("got %q, expected %d", respose.Status, u.expectStatus())
+	}
+	if u.ExpectBodyContains != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(respose.Body, maxBodySize))
+		if err != nil {
+			return respose.StatusCode, errors.Wrapf(err, "error reading the response of %q", u.URL)
+		}
+		if !strings.Contains(string(body), u.ExpectBodyContains) {
+			return respose.StatusCode, fmt.Errorf("got %q without %q in the body", respose.Status, u.ExpectBodyContains)
+		}
+	}
+	return respose.StatusCode, nil
+}
+
+// maxBodySize is how much of a response is searched for ExpectBodyContains
+const maxBodySize = 1 << 20
+
+func pingError(lastErr map[string]error) error {
+	var names []string
+	for name := range lastErr {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reasons []string
+	for _, name := range names {
+		reasons = append(reasons, fmt.Sprintf("%s (%v)", name, lastErr[name]))
+	}
+	return fmt.Errorf("services not up: %s", strings.Join(reasons, ", "))
+}
+
+// PodLogLines is how many of the last log lines of every container are shown
+// when a test fails
+var PodLogLines int64 = 50
+
+func dumpPodLogs(t *testing.T, clientset *kubernetes.Clientset, namespace string) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Logf("error listing pods for logs in namespace %q: %v", namespace, err)
+		return
+	}
+	for _, p := range pods.Items {
+		for _, c := range p.Spec.Containers {
+			logs, err := clientset.CoreV1().Pods(namespace).GetLogs(p.Name, &v1.PodLogOptions{
+				Container: c.Name,
+				TailLines: &PodLogLines,
+			}).Do().Raw()
+			if err != nil {
+				t.Logf("error getting logs of container %q in pod %q: %v", c.Name, p.Name, err)
+				continue
+			}
+			t.Logf("logs of container %q in pod %q:\n%s", c.Name, p.Name, string(logs))
+		}
+	}
+}
+
+func dumpEvents(t *testing.T, clientset *kubernetes.Clientset, namespace string) {
+	events, err := clientset.CoreV1().Events(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		t.Logf("error listing events in namespace %q: %v", namespace, err)
+		return
+	}
+	sort.Slice(events.Items, func(i, j int) bool {
+		return events.Items[i].LastTimestamp.Before(events.Items[j].LastTimestamp)
+	})
+
+	var out bytes.Buffer
+	for _, e := range events.Items {
+		fmt.Fprintf(&out, "%s\t%s/%s\t%s\t%s\n", e.LastTimestamp, e.InvolvedObject.Kind,
+			e.InvolvedObject.Name, e.Reason, e.Message)
+	}
+	t.Logf("events in namespace %q:\n%s", namespace, out.String())
+}
+
+// errWaitTimeout is returned by waitFor when the condition is not met in time
+var errWaitTimeout = fmt.Errorf("timed out waiting for the condition")
+
+// waitFor checks condition every PollInterval until it is done, it errors or the
+// timeout expires
+func waitFor(ctx context.Context, timeout time.Duration, condition func() (bool, error)) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := condition()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errWaitTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+// NamespaceDeleteTimeout is how long deleteNamespace waits for the namespace
+// to be terminated
+var NamespaceDeleteTimeout = 5 * time.Minute
+
+// CleanupVerifyTimeout is how long VerifyCleanup waits for what a test
+// deleted to be gone, e.g. persistent volumes being reclaimed
+var CleanupVerifyTimeout = 2 * time.Minute
+
+// VerifyCleanup checks that the test left nothing behind once it cleaned up:
+// not its namespace, e.g. stuck on a finalizer, not the persistent volumes
+// bound to claims in it, and not its cluster scoped resources
+func VerifyCleanup(ctx context.Context, t *testing.T, cluster *Cluster, test testData, result TestResult) error {
+	var left []string
+	err := waitFor(ctx, CleanupVerifyTimeout, func() (bool, error) {
+		var err error
+		left, err = leftovers(ctx, cluster, test, result)
+		return len(left) == 0, err
+	})
+	if err == errWaitTimeout {
+		return fmt.Errorf("left behind after %v: %s", CleanupVerifyTimeout, strings.Join(left, ", "))
+	} else if err != nil {
+		return errors.Wrap(err, "error verifying the cleanup")
+	}
+	t.Logf("nothing left behind in namespace %q", result.Namespace)
+	return nil
+}
+
+// leftovers lists what VerifyCleanup finds left behind, as kubectl names it
+func leftovers(ctx context.Context, cluster *Cluster, test testData, result TestResult) ([]string, error) {
+	clientset := cluster.Clientset
+	var left []string
+	// a namespace that is not ours is not deleted, nor the volumes in it
+	if !test.UseExistingNamespace {
+		ns, err := clientset.CoreV1().Namespaces().Get(result.Namespace, metav1.GetOptions{})
+		if err == nil {
+			left = append(left, fmt.Sprintf("namespace/%s (%s)", ns.Name, ns.Status.Phase))
+		} else if !apierrors.IsNotFound(err) {
+			return nil, errors.Wrap(err, "error getting the namespace")
+		}
+
+		pvs, err := clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing persistent volumes")
+		}
+		for _, pv := range pvs.Items {
+			if pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == result.Namespace {
+				left = append(left, fmt.Sprintf("persistentvolume/%s (%s)", pv.Name, pv.Status.Phase))
+			}
+		}
+	}
+
+	if len(result.ClusterScoped) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, KubectlTimeout)
+		defer cancel()
+
+		args := append([]string{"get", "--ignore-not-found", "-o", "name"}, result.ClusterScoped...)
+		output, err := kubectlCommand(ctx, cluster, args...).CombinedOutput()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error getting cluster scoped resources, got: %s", string(output))
+		}
+		for _, name := range strings.Split(string(output), "\n") {
+			if name = strings.TrimSpace(name); name != "" {
+				left = append(left, name)
+			}
+		}
+	}
+	return left, nil
+}
+
+// CapacityTimeout is how long a test waits for the cluster to have the
+// capacity -min-free-cpu and -min-free-memory ask for
+var CapacityTimeout = 10 * time.Minute
+
+// capacityMu admits the tests waiting for capacity one at a time
+var capacityMu sync.Mutex
+
+// WaitForCapacity waits until the schedulable nodes have at least cpu and
+// memory left that no pod requests yet. It is a coarse check: the capacity a
+// test admitted a moment ago needs is only seen once its pods are created.
+func WaitForCapacity(ctx context.Context, t *testing.T, clientset *kubernetes.Clientset, cpu, memory resource.Quantity) error {
+	capacityMu.Lock()
+	defer capacityMu.Unlock()
+
+	var freeCPU, freeMemory resource.Quantity
+	err := waitFor(ctx, CapacityTimeout, func() (bool, error) {
+		var err error
+		freeCPU, freeMemory, err = freeCapacity(clientset)
+		if err != nil {
+			return false, err
+		}
+		if freeCPU.Cmp(cpu) < 0 || freeMemory.Cmp(memory) < 0 {
+			t.Logf("waiting for capacity, free cpu %s, memory %s", freeCPU.String(), freeMemory.String())
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == errWaitTimeout {
+		return fmt.Errorf("timed out after %v waiting for %s cpu and %s memory to be free, have %s and %s",
+			CapacityTimeout, cpu.String(), memory.String(), freeCPU.String(), freeMemory.String())
+	}
+	return err
+}
+
+// freeCapacity is the allocatable cpu and memory of the schedulable nodes,
+// less what the pods that are not done yet request
+func freeCapacity(clientset *kubernetes.Clientset) (resource.Quantity, resource.Quantity, error) {
+	var cpu, memory resource.Quantity
+	nodes, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return cpu, memory, errors.Wrap(err, "error while listing all nodes")
+	}
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable {
+			continue
+		}
+		cpu.Add(node.Status.Allocatable[v1.ResourceCPU])
+		memory.Add(node.Status.Allocatable[v1.ResourceMemory])
+	}
+
+	pods, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return cpu, memory, errors.Wrap(err, "error while listing all pods")
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			cpu.Sub(c.Resources.Requests[v1.ResourceCPU])
+			memory.Sub(c.Resources.Requests[v1.ResourceMemory])
+		}
+	}
+	return cpu, memory, nil
+}
+
+// CleanupNamespaces deletes the namespaces left behind by earlier runs of the
+// tests, i.e. the ones labeled as created by the tests. With -cleanup-unlabeled
+// it also deletes the unlabeled namespaces named like the namespace of a test,
+// with or without the random suffix -unique-namespaces adds. Existing
+// namespaces the tests deploy into are left alone.
+func CleanupNamespaces(t *testing.T, clientset *kubernetes.Clientset, tests []testData) error {
+	var patterns []*regexp.Regexp
+	if *cleanupUnlabeled {
+		for _, test := range tests {
+			if test.UseExistingNamespace {
+				continue
+			}
+			// the suffix is made by rand.String, which has no vowels, so
+			// e.g. "wordpress-backup" is not taken for a leftover
+			patterns = append(patterns, regexp.MustCompile("^"+regexp.QuoteMeta(test.Namespace)+"(-[bcdfghjklmnpqrstvwxz0-9]{6})?$"))
+		}
+	}
+
+	namespaces, err := clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "error while listing all namespaces")
+	}
+	var wg sync.WaitGroup
+	for _, ns := range namespaces.Items {
+		leftover := ns.Labels[CreatedByLabel] == CreatedBy
+		for _, pattern := range patterns {
+			if pattern.MatchString(ns.Name) {
+				leftover = true
+				break
+			}
+		}
+		if leftover {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				deleteNamespace(t, clientset, name)
+			}(ns.Name)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+func deleteNamespace(t *testing.T, clientset *kubernetes.Clientset, namespace string) {
+	if err := clientset.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{}); err != nil {
+		t.Logf("error deleting namespace %q: %v", namespace, err)
+		return
+	}
+
+	// deletion only marks the namespace as terminating, wait for it to be gone
+	err := waitFor(context.Background(), NamespaceDeleteTimeout, func() (bool, error) {
+		_, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		t.Logf("error waiting for namespace %q to be deleted: %v", namespace, err)
+		return
+	}
+	t.Logf("successfully deleted namespace: %q", namespace)
+}
+
+type ServicePort struct {
+	Name string
+	Port int32
+	// PortName picks the service port by its name instead of Port
+	PortName string
+	// Path is requested when pinging the service, defaults to "/"
+	Path string
+	// ExpectStatus is the HTTP status code the service should respond with,
+	// defaults to 200
+	ExpectStatus int
+	// ExpectBodyContains is a string the response body should contain, e.g.
+	// to tell the service from a proxy error page that also returns 200
+	ExpectBodyContains string
+	// Scheme is either "http", the default, or "https"
+	Scheme string
+	// InsecureSkipVerify accepts any certificate an https service presents
+	InsecureSkipVerify bool
+	// Method is the HTTP method the service is pinged with, defaults to GET
+	Method string
+	// Headers are set on the requests, e.g. "Authorization" or "Content-Type"
+	Headers map[string]string
+	// Body is sent with the requests, e.g. a JSON document for a POST
+	Body string
+	// Username and Password authenticate the requests with basic auth, and
+	// BearerToken with a bearer token. The environment variables in them are
+	// expanded, e.g. "$WORDPRESS_PASSWORD", to keep secrets out of the test
+	// cases.
+	Username    string
+	Password    string
+	BearerToken string
+	// Ingress is the name of an ingress routing to the service, to reach the
+	// service through it instead of the node port
+	Ingress string
+	// DisableRedirects checks ExpectStatus against the first response
+	// instead of following redirects, e.g. to expect a 302 to a login page
+	DisableRedirects bool
+	// Protocol is ProtocolTCP for services that are only checked to accept
+	// connections, e.g. databases, and HTTP otherwise
+	Protocol string
+	// RequiredSuccesses is how many pings in a row the service has to
+	// respond to as expected to be up, e.g. 3 to not be fooled by a service
+	// that flaps while it starts, defaults to 1
+	RequiredSuccesses int
+	// MatchReadinessProbe pings the path the HTTP readiness probe of the
+	// pods behind the service checks on the same port, so the test and
+	// Kubernetes agree on what healthy means. A Path that differs from the
+	// probe is an error.
+	MatchReadinessProbe bool
+	// Timeout bounds every request to the service, or connection for
+	// ProtocolTCP, e.g. "30s" in a test case file, defaults to
+	// RequestTimeout
+	Timeout metav1.Duration
+}
+
+// HTTPTransport, when set, sends the pings of all the services, e.g. through
+// a proxy or with client certificates, and keeps their connections. The
+// InsecureSkipVerify of the service ports is then up to it.
+var HTTPTransport http.RoundTripper
+
+// RequestTimeout is how long a single ping of a service may take, unless its
+// ServicePort sets a Timeout
+var RequestTimeout = 5 * time.Second
+
+// ProtocolTCP is the ServicePort Protocol of non HTTP services
+const ProtocolTCP = "tcp"
+
+// matches tells if p is the service port to check
+func (s ServicePort) matches(p v1.ServicePort) bool {
+	if s.PortName != "" {
+		return p.Name == s.PortName
+	}
+	return p.Port == s.Port
+}
+
+// key identifies the service port among the endpoints, e.g. "wordpress:8080"
+func (s ServicePort) key() string {
+	if s.PortName != "" {
+		return fmt.Sprintf("%s:%s", s.Name, s.PortName)
+	}
+	return fmt.Sprintf("%s:%d", s.Name, s.Port)
+}
+
+func (s ServicePort) scheme() string {
+	if s.Scheme == "" {
+		return "http"
+	}
+	return s.Scheme
+}
+
+// client is the HTTP client the service is pinged with
+func (s ServicePort) client() *http.Client {
+	client := &http.Client{
+		Timeout: s.timeout(),
+	}
+	if HTTPTransport != nil {
+		client.Transport = HTTPTransport
+	} else if s.InsecureSkipVerify {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	if s.DisableRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+func (s ServicePort) requiredSuccesses() int {
+	if s.RequiredSuccesses < 1 {
+		return 1
+	}
+	return s.RequiredSuccesses
+}
+
+func (s ServicePort) timeout() time.Duration {
+	if s.Timeout.Duration == 0 {
+		return RequestTimeout
+	}
+	return s.Timeout.Duration
+}
+
+func (s ServicePort) method() string {
+	if s.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(s.Method)
+}
+
+func (s ServicePort) path() string {
+	if s.Path == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(s.Path, "/") {
+		return "/" + s.Path
+	}
+	return s.Path
+}
+
+func (s ServicePort) expectStatus() int {
+	if s.ExpectStatus == 0 {
+		return http.StatusOK
+	}
+	return s.ExpectStatus
+}
+
+// PodTarget is a pod the test waits on to be started. Pods are picked by the
+// label Selector, or when it is empty, by their name matching Name the way
+// Match says.
+type PodTarget struct {
+	Name     string
+	Selector map[string]string
+	// Match is how Name picks the pods, MatchSubstring by default
+	Match string
+	// Replicas is how many matching pods have to be started, e.g. all
+	// the replicas of a deployment, defaults to 1
+	Replicas int
+	// Namespace is where the pods are, when not in the namespace of the
+	// test, e.g. an operator deployed along with the application
+	Namespace string
+
+	// regex is Name compiled for MatchRegex, see compile
+	regex *regexp.Regexp
+}
+
+// key tells the target apart from the other targets of a test, and names it
+// in the logs, e.g. "web", "{app=web}" or "regex:^web-"
+func (pt PodTarget) key() string {
+	key := pt.Name
+	if len(pt.Selector) != 0 {
+		key = "{" + labels.SelectorFromSet(pt.Selector).String() + "}"
+	} else if pt.Match != "" && pt.Match != MatchSubstring {
+		key = pt.Match + ":" + key
+	}
+	if pt.Namespace != "" {
+		key = pt.Namespace + "/" + key
+	}
+	return key
+}
+
+func (pt PodTarget) replicas() int {
+	if pt.Replicas < 1 {
+		return 1
+	}
+	return pt.Replicas
+}
+
+// How the Name of a PodTarget is matched against the pod names
+const (
+	// MatchSubstring picks the pods with Name anywhere in their name
+	MatchSubstring = "substring"
+	// MatchExact picks the pod named Name
+	MatchExact = "exact"
+	// MatchRegex picks the pods whose name matches the regular expression
+	// in Name, e.g. "^web-[a-f0-9]+-[a-z0-9]+$"
+	MatchRegex = "regex"
+)
+
+func (pt PodTarget) matches(p v1.Pod) bool {
+	if len(pt.Selector) != 0 {
+		return labels.SelectorFromSet(pt.Selector).Matches(labels.Set(p.Labels))
+	}
+	switch pt.Match {
+	case MatchExact:
+		return p.Name == pt.Name
+	case MatchRegex:
+		return pt.regex != nil && pt.regex.MatchString(p.Name)
+	}
+	return strings.Contains(p.Name, pt.Name)
+}
+
+// validate checks Match, and the regular expression of MatchRegex
+func (pt PodTarget) validate() error {
+	return pt.compile()
+}
+
+// compile checks Match, and compiles the regular expression of MatchRegex
+// once, instead of for every pod it is matched against
+func (pt *PodTarget) compile() error {
+	switch pt.Match {
+	case "", MatchSubstring, MatchExact:
+		return nil
+	case MatchRegex:
+		regex, err := regexp.Compile(pt.Name)
+		if err != nil {
+			return errors.Wrapf(err, "pod target %q", pt.Name)
+		}
+		pt.regex = regex
+		return nil
+	}
+	return fmt.Errorf("pod target %q has unknown match %q", pt.Name, pt.Match)
+}
+
+type testData struct {
+	TestName  string
+	Namespace string
+	// InputFiles may hold globs, e.g. "examples/wordpress/*.yaml"
+	InputFiles []string
+	// Input is kedge YAML fed to kedge on stdin, instead of InputFiles
+	Input string
+	// Golden is a file with the manifests kedge is expected to generate,
+	// compared to what it generates after normalizing both
+	Golden string
+	// ExpectedResources is how many objects of every kind kedge is expected
+	// to generate, e.g. {"Deployment": 1, "Service": 1}. Kinds left out are
+	// expected not to be generated.
+	ExpectedResources map[string]int
+	// KappArgs are passed to kedge after the input files
+	KappArgs []string
+	// KappSubcommand is KappApply to deploy with "kedge apply" instead of
+	// kubectl, testing kedge's own apply. The manifests are still generated
+	// first, for Golden and the cleanup.
+	KappSubcommand string
+	// Env is set for kedge, e.g. for the variables the input files
+	// reference, without changing the environment of the tests
+	Env          map[string]string
+	PodStarted   []string
+	PodTargets   []PodTarget
+	RequireReady bool
+	// Deployments, StatefulSets and DaemonSets are waited on to become
+	// ready by name, after the pods
+	Deployments  []string
+	StatefulSets []string
+	DaemonSets   []string
+	// Jobs are waited on to complete
+	Jobs []string
+	// PersistentVolumeClaims are waited on to be bound, before the pods
+	// that cannot start without them
+	PersistentVolumeClaims []string
+	// KubeWait are conditions for "kubectl wait", waited on last, e.g.
+	// "--for=condition=Available deployment/web"
+	KubeWait         []string
+	NodePortServices []ServicePort
+	// UseExistingNamespace deploys into Namespace as is, for clusters where
+	// the tests cannot create namespaces. The namespace has to exist and is
+	// never deleted, only the resources the test created in it are.
+	UseExistingNamespace bool
+	// KubeDelete deletes the generated manifests with "kubectl delete -f"
+	// once the services are up, to check they can be deleted as well
+	KubeDelete bool
+	// Timeout bounds the whole test, from generating the manifests to
+	// pinging the services, e.g. "10m" in a test case file. Zero leaves
+	// only the timeouts of the single phases.
+	Timeout metav1.Duration
+}
+
+// podTargets combines the name matched PodStarted with the PodTargets
+func (test testData) podTargets() []PodTarget {
+	var targets []PodTarget
+	for _, name := range test.PodStarted {
+		targets = append(targets, PodTarget{Name: name})
+	}
+	return append(targets, test.PodTargets...)
+}
+
+// LoadTestData reads the test cases from a YAML or JSON file holding a list
+// of testData, e.g.
+//
+//	# testcases/wordpress.yaml
+//	- testName: Normal Wordpress test
+//	  namespace: wordpress
+//	  inputFiles:
+//	  - db.yaml
+//	  - web.yaml
+//	  podStarted:
+//	  - web
+//	  nodePortServices:
+//	  - name: wordpress
+//	    port: 8080
+//
+// If path is a directory the .yaml, .yml and .json files in it holding a list
+// are read, the others, e.g. the kedge files of the tests, are skipped.
+// Relative input files are looked up next to the file they are listed in.
+func LoadTestData(path string) ([]testData, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read test cases")
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot list test cases in %q", path)
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+	}
+
+	var tests []testData
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read test cases")
+		}
+		if info.IsDir() && !isList(data) {
+			continue
+		}
+		var fileTests []testData
+		if err := yaml.Unmarshal(data, &fileTests); err != nil {
+			return nil, errors.Wrapf(err, "cannot parse test cases in %q", file)
+		}
+		for _, test := range fileTests {
+			if err := validateTestData(&test, filepath.Dir(file)); err != nil {
+				return nil, errors.Wrapf(err, "invalid test case in %q", file)
+			}
+			tests = append(tests, test)
+		}
+	}
+	return tests, nil
+}
+
+// isList tells if data is a YAML or JSON list. Data that cannot be parsed
+// counts as one, to report why.
+func isList(data []byte) bool {
+	var top interface{}
+	if err := yaml.Unmarshal(data, &top); err != nil {
+		return true
+	}
+	_, ok := top.([]interface{})
+	return ok
+}
+
+// validateTestData checks that a loaded test can be run, making the relative
+// input files relative to dir on the way
+func validateTestData(test *testData, dir string) error {
+	if test.TestName == "" {
+		return fmt.Errorf("test has no name")
+	}
+	if test.Namespace == "" {
+		return fmt.Errorf("test %q has no namespace", test.TestName)
+	}
+	if len(test.InputFiles) == 0 && test.Input == "" {
+		return fmt.Errorf("test %q has no input files", test.TestName)
+	}
+	if len(test.InputFiles) > 0 && test.Input != "" {
+		return fmt.Errorf("test %q has both input files and input", test.TestName)
+	}
+	for i, file := range test.InputFiles {
+		file = expandEnv(file, test.Env)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		if isGlob(file) {
+			if _, err := expandInputFiles([]string{file}, nil); err != nil {
+				return errors.Wrapf(err, "test %q", test.TestName)
+			}
+		} else if _, err := os.Stat(file); err != nil {
+			return errors.Wrapf(err, "test %q", test.TestName)
 		}
+		test.InputFiles[i] = file
 	}
-	t.Logf("endpoints: %#v", endpoint)
-	return endpoint, nil
-}
-
-func pingEndPoints(t *testing.T, ep map[string]string) error {
-	for {
-		for e, u := range ep {
-			timeout := time.Duration(5 * time.Second)
-			client := http.Client{
-				Timeout: timeout,
-			}
-			respose, err := client.Get(u)
-			if err != nil {
-				t.Logf("error while making http request %q for service %q, err: %v", u, e, err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			if respose.Status == "200 OK" {
-				t.Logf("%q is running!", e)
-				delete(ep, e)
-			} else {
-				return fmt.Errorf("for service %q got %q", e, respose.Status)
-			}
+	switch test.KappSubcommand {
+	case "", KappGenerate, KappApply:
+	default:
+		return fmt.Errorf("test %q has unknown kedge subcommand %q", test.TestName, test.KappSubcommand)
+	}
+	targets := make(map[string]bool)
+	for _, target := range test.podTargets() {
+		if err := target.validate(); err != nil {
+			return errors.Wrapf(err, "test %q", test.TestName)
 		}
-		if len(ep) == 0 {
-			break
+		if targets[target.key()] {
+			return fmt.Errorf("test %q waits on pod target %q more than once", test.TestName, target.key())
+		}
+		targets[target.key()] = true
+	}
+	if test.Golden != "" {
+		test.Golden = expandEnv(test.Golden, test.Env)
+		if !filepath.IsAbs(test.Golden) {
+			test.Golden = filepath.Join(dir, test.Golden)
 		}
 	}
 	return nil
 }
 
-func deleteNamespace(t *testing.T, clientset *kubernetes.Clientset, namespace string) {
-	if err := clientset.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{}); err != nil {
-		t.Logf("error deleting namespace %q: %v", namespace, err)
+// expandInputFiles expands the variables in the input files, then replaces
+// the globs among them, e.g. "examples/wordpress/*.yaml", with the files they
+// match. A glob matching nothing is an error.
+func expandInputFiles(files []string, env map[string]string) ([]string, error) {
+	var expanded []string
+	for _, file := range files {
+		file = expandEnv(file, env)
+		if !isGlob(file) {
+			expanded = append(expanded, file)
+			continue
+		}
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid input files pattern %q", file)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no input files match %q", file)
+		}
+		expanded = append(expanded, matches...)
 	}
-	t.Logf("successfully deleted namespace: %q", namespace)
-}
-
-type ServicePort struct {
-	Name string
-	Port int32
+	return expanded, nil
 }
 
-type testData struct {
-	TestName         string
-	Namespace        string
-	InputFiles       []string
-	PodStarted       []string
-	NodePortServices []ServicePort
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
 }
 
 func Test_Integration(t *testing.T) {
-	clientset, err := createClient()
-	if err != nil {
-		t.Fatalf("error getting kube client: %v", err)
+	if PollInterval <= 0 {
+		t.Fatalf("-poll-interval has to be positive, got %v", PollInterval)
 	}
-	KappLoc, err = FindKapp(t)
-	if err != nil {
-		t.Fatal(err)
+
+	clusters := []Cluster{{Kubeconfig: *kubeconfig, Context: *kubeContext}}
+	if *clusterList != "" && !*dryRunFlag {
+		clusters = parseClusters(*clusterList, *kubeconfig)
 	}
-	KubectlLoc, err = FindKubectl(t)
-	if err != nil {
-		t.Fatal(err)
+
+	var err error
+	// a dry run needs neither the cluster nor kubectl
+	if !*dryRunFlag {
+		for i := range clusters {
+			clusters[i].Clientset, err = createClient(clusters[i].Kubeconfig, clusters[i].Context, impersonation(), float32(*clientQPS), *clientBurst)
+			if err != nil {
+				t.Fatalf("error getting kube client %s: %v", clusters[i].Name, err)
+			}
+			if err := checkConnection(t, clusters[i].Clientset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		KubectlLoc, err = FindKubectl(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckVersion(t, KubectlLoc, *minKubectlVersion, KubectlTimeout, "version", "--client"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// cleaning up does not run kedge, nor does another tool generating the
+	// manifests
+	if !*cleanupOnly && *generateCommand == "" {
+		KappLoc, err = FindKapp(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckVersion(t, KappLoc, *minKedgeVersion, KappTimeout, "version"); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	tests := []testData{
@@ -300,7 +2608,8 @@ func Test_Integration(t *testing.T) {
 				ProjectPath + "examples/health/db.yaml",
 				ProjectPath + "examples/health/web.yaml",
 			},
-			PodStarted: []string{"web"},
+			PodStarted:   []string{"web"},
+			RequireReady: true,
 			NodePortServices: []ServicePort{
 				{Name: "wordpress", Port: 8080},
 			},
@@ -312,7 +2621,8 @@ func Test_Integration(t *testing.T) {
 				ProjectPath + "examples/healthchecks/db.yaml",
 				ProjectPath + "examples/healthchecks/web.yaml",
 			},
-			PodStarted: []string{"web"},
+			PodStarted:   []string{"web"},
+			RequireReady: true,
 			NodePortServices: []ServicePort{
 				{Name: "wordpress", Port: 8080},
 			},
@@ -342,45 +2652,688 @@ func Test_Integration(t *testing.T) {
 		},
 	}
 
-	for _, test := range tests {
-		test := test // capture range variable
-		t.Run(test.TestName, func(t *testing.T) {
-			t.Parallel()
-			// create a namespace
-			_, err := createNS(clientset, test.Namespace)
-			if err != nil {
-				t.Fatalf("error creating namespace: %v", err)
+	if *testCases != "" {
+		tests, err = LoadTestData(*testCases)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// kedge is not looked for when another tool generates the manifests
+	if *generateCommand != "" {
+		for _, test := range tests {
+			if test.KappSubcommand == KappApply {
+				t.Fatalf("test %q deploys with kedge apply, it cannot be run with -generate-command", test.TestName)
 			}
-			t.Logf("namespace %q created", test.Namespace)
-			defer deleteNamespace(t, clientset, test.Namespace)
+		}
+	}
 
-			// run kapp
-			convertedOutput, err := RunKapp(test.InputFiles)
-			if err != nil {
-				t.Fatalf("error running kapp: %v", err)
+	if *cleanupOnly {
+		if *dryRunFlag {
+			t.Fatal("-cleanup needs a cluster, it cannot be combined with -dry-run")
+		}
+		for i := range clusters {
+			if err := CleanupNamespaces(t, clusters[i].Clientset, tests); err != nil {
+				t.Error(err)
+			}
+		}
+		return
+	}
+
+	// zero, unless the tests should wait for capacity
+	var minCPU, minMemory resource.Quantity
+	if *minFreeCPU != "" {
+		if minCPU, err = resource.ParseQuantity(*minFreeCPU); err != nil {
+			t.Fatalf("invalid -min-free-cpu: %v", err)
+		}
+	}
+	if *minFreeMemory != "" {
+		if minMemory, err = resource.ParseQuantity(*minFreeMemory); err != nil {
+			t.Fatalf("invalid -min-free-memory: %v", err)
+		}
+	}
+	waitForCapacity := !*dryRunFlag && (*minFreeCPU != "" || *minFreeMemory != "")
+
+	if *dryRunFlag && *dryRunOutput != "" {
+		if err := os.MkdirAll(*dryRunOutput, 0755); err != nil {
+			t.Fatalf("cannot create -dry-run-output: %v", err)
+		}
+	}
+
+	t.Logf("run id: %s", RunID)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if *suiteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *suiteTimeout)
+		defer cancel()
+	}
+	// on ctrl-c stop the tests, which delete their namespaces on the way out,
+	// instead of getting killed and leaving them behind
+	signals := make(chan os.Signal, 1)
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			// a second one kills the tests right away
+			signal.Stop(signals)
+			fmt.Fprintf(os.Stderr, "got %v, stopping the tests and cleaning up after them, again to exit right away\n", sig)
+			interrupted <- sig
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	// limits the tests deploying to the cluster at once
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	sem := make(chan struct{}, *concurrency)
+
+	var mu sync.Mutex
+	var results []TestResult
+	suiteStart := time.Now()
+	// the group only returns once all the parallel tests in it are done,
+	// with -sequential every test is done before the next one starts
+	t.Run("group", func(t *testing.T) {
+		for i := range clusters {
+			cluster := &clusters[i]
+			for _, test := range tests {
+				test := test // capture range variable
+				name := test.TestName
+				if cluster.Name != "" {
+					name = cluster.Name + "/" + test.TestName
+				}
+				t.Run(name, func(t *testing.T) {
+					if !*sequential {
+						t.Parallel()
+					}
+					sem <- struct{}{}
+					defer func() { <-sem }()
+
+					var result TestResult
+					if ctx.Err() != nil {
+						// the suite was stopped while the test was queued
+						result = TestResult{Name: test.TestName, Cluster: cluster.Name, Namespace: test.Namespace, Err: fmt.Errorf("not started before the suite was stopped"), Unfinished: true}
+					} else if waitForCapacity {
+						err := WaitForCapacity(ctx, t, cluster.Clientset, minCPU, minMemory)
+						result = TestResult{Name: test.TestName, Cluster: cluster.Name, Namespace: test.Namespace, Err: err}
+					}
+					if result.Err == nil {
+						result = runTest(ctx, t, cluster, test)
+						result.Attempts = 1
+						for result.Err != nil && !result.Unfinished && result.Attempts <= *retries {
+							t.Logf("attempt %d of %d failed, retrying: %v", result.Attempts, *retries+1, result.Err)
+							attempts := result.Attempts
+							result = runTest(ctx, t, cluster, test)
+							result.Attempts = attempts + 1
+						}
+					}
+					mu.Lock()
+					results = append(results, result)
+					mu.Unlock()
+					if result.Err != nil {
+						t.Fatal(result.Err)
+					}
+				})
+			}
+		}
+	})
+
+	if *junitOutput != "" {
+		if err := WriteJUnitReport(*junitOutput, "kedge e2e", time.Since(suiteStart), results); err != nil {
+			t.Error(err)
+		}
+	}
+	if *reportOutput != "" {
+		if err := WriteReport(*reportOutput, RunID, time.Since(suiteStart), results); err != nil {
+			t.Error(err)
+		}
+	}
+
+	var failed, unfinished, flaky []string
+	for _, result := range results {
+		if result.Err != nil {
+			failed = append(failed, result.FullName())
+		} else if result.Attempts > 1 {
+			flaky = append(flaky, fmt.Sprintf("%s (%d attempts)", result.FullName(), result.Attempts))
+		}
+		if result.Unfinished {
+			unfinished = append(unfinished, result.FullName())
+		}
+	}
+	if len(unfinished) > 0 {
+		sort.Strings(unfinished)
+		select {
+		case sig := <-interrupted:
+			t.Errorf("suite stopped by %v, %d tests did not finish: %s", sig, len(unfinished), strings.Join(unfinished, ", "))
+		default:
+			t.Errorf("suite timed out after %v, %d tests did not finish: %s", *suiteTimeout, len(unfinished), strings.Join(unfinished, ", "))
+		}
+	}
+	t.Logf("results:\n%s", resultsTable(results))
+	t.Logf("%d/%d tests passed", len(results)-len(failed), len(results))
+	if len(flaky) > 0 {
+		sort.Strings(flaky)
+		t.Logf("passed only after failing: %s", strings.Join(flaky, ", "))
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		t.Errorf("%d of %d tests failed: %s", len(failed), len(results), strings.Join(failed, ", "))
+	}
+}
+
+// generate runs kapp for the test and checks it generated valid manifests
+func generate(ctx context.Context, t *testing.T, test testData) ([]byte, []unstructured.Unstructured, error) {
+	var kappResult *KappResult
+	var err error
+	if test.Input != "" {
+		kappResult, err = RunKappInput(ctx, KappGenerate, []byte(test.Input), test.Env, test.KappArgs...)
+	} else {
+		var files []string
+		files, err = expandInputFiles(test.InputFiles, test.Env)
+		if err != nil {
+			return nil, nil, err
+		}
+		kappResult, err = RunKapp(ctx, KappGenerate, files, test.Env, test.KappArgs...)
+	}
+	if err != nil {
+		t.Logf("kapp exited with %d, stdout:\n%s", kappResult.ExitCode, kappResult.Stdout)
+		return nil, nil, fmt.Errorf("error running kapp: %v", err)
+	}
+	objs, err := ParseManifests(kappResult.Stdout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kapp generated invalid manifests: %v", err)
+	}
+	if len(objs) == 0 {
+		return nil, nil, fmt.Errorf("kapp generated no manifests")
+	}
+	t.Logf("kapp generated: %v", ResourceIDs(objs))
+	if len(test.ExpectedResources) > 0 {
+		if err := checkResourceCounts(objs, test.ExpectedResources); err != nil {
+			return nil, nil, err
+		}
+	}
+	if test.Golden != "" && *updateGolden {
+		if err := writeGolden(test.Golden, objs); err != nil {
+			return nil, nil, err
+		}
+		t.Logf("updated golden file %s", test.Golden)
+	} else if test.Golden != "" {
+		if err := compareGolden(test.Golden, objs); err != nil {
+			return nil, nil, err
+		}
+	}
+	return kappResult.Stdout, objs, nil
+}
+
+// kappApply deploys the test into namespace with "kedge apply", which runs
+// kubectl with the kubeconfig in $KUBECONFIG
+func kappApply(ctx context.Context, t *testing.T, cluster *Cluster, test testData, namespace string) error {
+	if cluster.Context != "" {
+		return fmt.Errorf("kedge apply deploys to the current context, it cannot pick context %q", cluster.Context)
+	}
+	env := make(map[string]string)
+	for k, v := range test.Env {
+		env[k] = v
+	}
+	if cluster.Kubeconfig != "" && !useInClusterConfig(cluster.Kubeconfig) {
+		env["KUBECONFIG"] = cluster.Kubeconfig
+	}
+	args := append(append([]string{}, test.KappArgs...), "--namespace", namespace)
+
+	var kappResult *KappResult
+	var err error
+	if test.Input != "" {
+		kappResult, err = RunKappInput(ctx, KappApply, []byte(test.Input), env, args...)
+	} else {
+		var files []string
+		files, err = expandInputFiles(test.InputFiles, test.Env)
+		if err != nil {
+			return err
+		}
+		kappResult, err = RunKapp(ctx, KappApply, files, env, args...)
+	}
+	if kappResult != nil {
+		t.Logf("kapp apply in namespace %q:\n%s", namespace, kappResult.Stdout)
+	}
+	return err
+}
+
+// kubectlNames names the objects the way kubectl does, e.g. "deployment/web"
+func kubectlNames(objs []unstructured.Unstructured) []string {
+	var names []string
+	for _, obj := range objs {
+		names = append(names, strings.ToLower(obj.GetKind())+"/"+obj.GetName())
+	}
+	return names
+}
+
+// checkResourceCounts compares how many objects of every kind there are to
+// the expected counts
+func checkResourceCounts(objs []unstructured.Unstructured, expected map[string]int) error {
+	counts := make(map[string]int)
+	for _, obj := range objs {
+		counts[obj.GetKind()]++
+	}
+	kinds := make(map[string]bool)
+	for kind := range counts {
+		kinds[kind] = true
+	}
+	for kind := range expected {
+		kinds[kind] = true
+	}
+
+	var mismatches []string
+	for kind := range kinds {
+		if counts[kind] != expected[kind] {
+			mismatches = append(mismatches, fmt.Sprintf("%d %s, expected %d", counts[kind], kind, expected[kind]))
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("kapp generated %s", strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// writeGolden replaces the golden file with the normalized objects
+func writeGolden(golden string, objs []unstructured.Unstructured) error {
+	data, err := NormalizeManifests(objs)
+	if err != nil {
+		return errors.Wrap(err, "cannot normalize the generated manifests")
+	}
+	if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+		return errors.Wrap(err, "cannot create the directory of the golden file")
+	}
+	return errors.Wrap(ioutil.WriteFile(golden, data, 0644), "cannot write golden file")
+}
+
+// compareGolden checks the generated objects against the manifests in the
+// golden file, after normalizing both, and fails with a unified diff of the
+// two if they differ
+func compareGolden(golden string, objs []unstructured.Unstructured) error {
+	got, err := NormalizeManifests(objs)
+	if err != nil {
+		return errors.Wrap(err, "cannot normalize the generated manifests")
+	}
+	data, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return errors.Wrap(err, "cannot read golden file")
+	}
+	wantObjs, err := ParseManifests(data)
+	if err != nil {
+		return errors.Wrapf(err, "invalid golden file %q", golden)
+	}
+	want, err := NormalizeManifests(wantObjs)
+	if err != nil {
+		return errors.Wrapf(err, "cannot normalize golden file %q", golden)
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(want)),
+		B:        difflib.SplitLines(string(got)),
+		FromFile: golden,
+		ToFile:   "generated",
+		Context:  3,
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot diff against golden file")
+	}
+	return fmt.Errorf("generated manifests differ from golden file %q:\n%s", golden, diff)
+}
+
+// NormalizeManifests renders the objects as YAML that only changes along with
+// what kedge generates: the objects are sorted by kind, namespace and name,
+// their keys are sorted, and the fields the cluster fills in are dropped
+func NormalizeManifests(objs []unstructured.Unstructured) ([]byte, error) {
+	ids := ResourceIDs(objs)
+	order := make([]int, len(objs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return ids[order[a]].String() < ids[order[b]].String()
+	})
+
+	var out bytes.Buffer
+	for n, i := range order {
+		// work on a copy, the objects are still deployed as they are
+		data, err := objs[i].MarshalJSON()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot marshal %s", ids[i])
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal(data, &content); err != nil {
+			return nil, errors.Wrapf(err, "cannot unmarshal %s", ids[i])
+		}
+		delete(content, "status")
+		if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+			for _, field := range []string{"creationTimestamp", "resourceVersion", "uid", "selfLink", "generation"} {
+				delete(metadata, field)
 			}
-			//t.Log(string(convertedOutput))
+		}
+
+		// keys come out sorted
+		data, err = yaml.Marshal(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot marshal %s", ids[i])
+		}
+		if n > 0 {
+			out.WriteString("---\n")
+		}
+		out.Write(data)
+	}
+	return out.Bytes(), nil
+}
+
+// dryRun only generates the manifests for the test, and writes them to
+// stdout or to a file in -dry-run-output
+func dryRun(ctx context.Context, t *testing.T, test testData, result *TestResult) error {
+	start := time.Now()
+	manifests, _, err := generate(ctx, t, test)
+	result.addPhase(PhaseGenerate, start)
+	if err != nil {
+		return err
+	}
+
+	if *dryRunOutput == "" {
+		fmt.Printf("# %s\n%s", test.TestName, manifests)
+		return nil
+	}
+	path := filepath.Join(*dryRunOutput, test.Namespace+".yaml")
+	if err := ioutil.WriteFile(path, manifests, 0644); err != nil {
+		return errors.Wrap(err, "cannot write the manifests")
+	}
+	t.Logf("manifests written to %q", path)
+	return nil
+}
+
+// waitForControllers waits on the deployments, statefulsets, daemonsets and
+// jobs the test lists, and then on its kubectl wait conditions
+func waitForControllers(ctx context.Context, t *testing.T, cluster *Cluster, namespace string, test testData) error {
+	clientset := cluster.Clientset
+	if len(test.Deployments) > 0 {
+		if err := DeploymentsAvailable(ctx, t, clientset, namespace, test.Deployments, PodStartTimeout); err != nil {
+			return err
+		}
+	}
+	if len(test.StatefulSets) > 0 {
+		if err := StatefulSetsReady(ctx, t, clientset, namespace, test.StatefulSets, PodStartTimeout); err != nil {
+			return err
+		}
+	}
+	if len(test.DaemonSets) > 0 {
+		if err := DaemonSetsReady(ctx, t, clientset, namespace, test.DaemonSets, PodStartTimeout); err != nil {
+			return err
+		}
+	}
+	if len(test.Jobs) > 0 {
+		if err := JobsComplete(ctx, t, clientset, namespace, test.Jobs, PodStartTimeout); err != nil {
+			return err
+		}
+	}
+	for _, condition := range test.KubeWait {
+		if err := RunKubeWait(ctx, t, cluster, namespace, condition, PodStartTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTest runs the test, or only generates its manifests on a dry run
+func runTest(ctx context.Context, t *testing.T, cluster *Cluster, test testData) TestResult {
+	result := TestResult{
+		Name:      test.TestName,
+		Cluster:   cluster.Name,
+		Namespace: test.Namespace,
+	}
+	testCtx := ctx
+	if test.Timeout.Duration > 0 {
+		var cancel context.CancelFunc
+		testCtx, cancel = context.WithTimeout(ctx, test.Timeout.Duration)
+		defer cancel()
+	}
 
-			// run kubectl create
-			if err := RunKubeCreate(t, convertedOutput, test.Namespace); err != nil {
-				t.Fatalf("error running kubectl create: %v", err)
+	start := time.Now()
+	if *dryRunFlag {
+		result.Err = dryRun(testCtx, t, test, &result)
+	} else {
+		result.Err = deployAndCheck(testCtx, t, cluster, test, &result)
+		// a failed test kept around to debug is not cleaned up
+		if *verifyCleanup && (result.Err == nil || !*keepOnFailure) {
+			cleanupStart := time.Now()
+			err := VerifyCleanup(ctx, t, cluster, test, result)
+			if result.Err == nil {
+				result.addPhase(PhaseCleanup, cleanupStart)
+				result.Err = err
+			} else if err != nil {
+				t.Logf("error verifying the cleanup of the failed test: %v", err)
 			}
+		}
+	}
+	result.Duration = time.Since(start)
+	// our own deadline, as opposed to the suite being stopped
+	if result.Err != nil && testCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		t.Logf("error at the deadline: %v", result.Err)
+		result.Err = fmt.Errorf("test exceeded %v deadline at phase: %s", test.Timeout.Duration, result.lastPhase())
+	} else if result.Err != nil && ctx.Err() != nil {
+		t.Logf("error when the suite was stopped: %v", result.Err)
+		result.Err = fmt.Errorf("suite stopped at phase: %s: %v", result.lastPhase(), ctx.Err())
+		result.Unfinished = true
+	}
+	t.Logf("result: %s", result)
+	return result
+}
+
+// writeManifests writes the manifests of a test to a new temporary file, and
+// returns its path
+func writeManifests(namespace string, manifests []byte) (string, error) {
+	file, err := ioutil.TempFile("", fmt.Sprintf("kedge-e2e-%s-", namespace))
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(manifests); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
 
-			// see if the pods are running
-			if err := PodsStarted(t, clientset, test.Namespace, test.PodStarted); err != nil {
-				t.Fatalf("error finding running pods: %v", err)
+// deployAndCheck deploys what kedge generates for the test in a new
+// namespace, and checks that it starts and serves
+func deployAndCheck(ctx context.Context, t *testing.T, cluster *Cluster, test testData, result *TestResult) (err error) {
+	clientset := cluster.Clientset
+	namespace := test.Namespace
+	if test.UseExistingNamespace {
+		if _, err := clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("error finding existing namespace: %v", err)
+		}
+		t.Logf("using existing namespace %q", namespace)
+		// the namespace is not ours to delete, only what the test created in it
+		defer func() {
+			if err != nil && *keepOnFailure {
+				t.Logf("keeping the resources of the failed test in namespace %q: %v", namespace, result.Created)
+				return
+			}
+			if err := DeleteResources(context.Background(), t, cluster, namespace, result.Created); err != nil {
+				t.Logf("error deleting resources from namespace %q: %v", namespace, err)
+			}
+		}()
+	} else {
+		// create a namespace
+		if *uniqueNamespaces {
+			namespace = uniqueNamespace(test.Namespace)
+		}
+		_, err = createNS(ctx, t, clientset, namespace)
+		if *kubeApply && apierrors.IsAlreadyExists(err) {
+			t.Logf("reusing existing namespace %q", namespace)
+		} else if err != nil {
+			return fmt.Errorf("error creating namespace: %v", err)
+		} else {
+			t.Logf("namespace %q created", namespace)
+		}
+		defer func() {
+			if err != nil && *keepOnFailure {
+				t.Logf("keeping namespace %q of the failed test, inspect it with: kubectl -n %s get all", namespace, namespace)
+				return
 			}
+			deleteNamespace(t, clientset, namespace)
+		}()
+	}
+	result.Namespace = namespace
+	// runs before the namespace, and the pods with it, are gone
+	defer func() {
+		if err != nil {
+			dumpEvents(t, clientset, namespace)
+			dumpPodLogs(t, clientset, namespace)
+		}
+	}()
+
+	// run kapp
+	start := time.Now()
+	convertedOutput, objs, err := generate(ctx, t, test)
+	result.addPhase(PhaseGenerate, start)
+	if err != nil {
+		return err
+	}
+	//t.Log(string(convertedOutput))
 
-			// get endpoints for all services
-			endPoints, err := getEndPoints(t, clientset, test.Namespace, test.NodePortServices)
+	// keep what was deployed around to reproduce a failure by hand, in a
+	// file of its own as the namespace may be the same on several clusters
+	if manifestPath, werr := writeManifests(namespace, convertedOutput); werr != nil {
+		t.Logf("error writing the generated manifests: %v", werr)
+	} else {
+		defer func() {
+			// err is what deployAndCheck returns
 			if err != nil {
-				t.Fatalf("error getting nodes: %v", err)
+				t.Logf("generated manifests kept in %s", manifestPath)
+				return
+			}
+			os.Remove(manifestPath)
+		}()
+	}
+
+	// cluster scoped resources outlive the namespace, delete them on their own
+	result.ClusterScoped, err = ClusterScoped(clientset, objs)
+	if err != nil {
+		return err
+	}
+	if len(result.ClusterScoped) > 0 {
+		t.Logf("cluster scoped resources to clean up: %v", result.ClusterScoped)
+		defer func() {
+			if err != nil && *keepOnFailure {
+				t.Logf("keeping cluster scoped resources of the failed test: %v", result.ClusterScoped)
+				return
 			}
+			if err := DeleteResources(context.Background(), t, cluster, "", result.ClusterScoped); err != nil {
+				t.Logf("error deleting cluster scoped resources: %v", err)
+			}
+		}()
+	}
 
-			if err := pingEndPoints(t, endPoints); err != nil {
-				t.Fatalf("error pinging endpoint: %v", err)
+	// run kubectl create, or apply, unless kedge deploys on its own
+	start = time.Now()
+	if test.KappSubcommand == KappApply {
+		// some of the resources may be there even when kedge failed
+		result.Created = kubectlNames(objs)
+		err = kappApply(ctx, t, cluster, test, namespace)
+		result.addPhase(PhaseApply, start)
+		if err != nil {
+			return fmt.Errorf("error running kapp apply: %v", err)
+		}
+	} else {
+		verb := "create"
+		if *kubeApply {
+			verb = "apply"
+		}
+		err = retryTransient(ctx, t, "running kubectl "+verb, func() error {
+			var err error
+			if *kubeApply {
+				result.Created, err = RunKubeApply(ctx, t, cluster, convertedOutput, namespace)
+				return err
 			}
-			t.Logf("Successfully pinged all endpoints!")
+			result.Created, err = RunKubeCreate(ctx, t, cluster, convertedOutput, namespace)
+			if err != nil && len(result.Created) > 0 {
+				// creating them again would fail on what was created
+				return fatalError{err}
+			}
+			return err
 		})
+		result.addPhase(PhaseApply, start)
+		if err != nil {
+			return fmt.Errorf("error running kubectl %s: %v", verb, err)
+		}
+	}
+
+	// see if the pods are running
+	start = time.Now()
+	if len(test.PersistentVolumeClaims) > 0 {
+		err = PVCsBound(ctx, t, clientset, namespace, test.PersistentVolumeClaims, PVCBindTimeout)
+		if err != nil {
+			result.addPhase(PhasePodReady, start)
+			return fmt.Errorf("error waiting for persistent volume claims: %v", err)
+		}
+	}
+	podStats, err := PodsStarted(ctx, t, clientset, namespace, test.podTargets(), test.RequireReady, PodStartTimeout)
+	result.PodChecks, result.Restarts = podStats.Checks, podStats.Restarts
+	if err != nil {
+		result.addPhase(PhasePodReady, start)
+		return fmt.Errorf("error finding running pods: %v", err)
+	}
+	err = waitForControllers(ctx, t, cluster, namespace, test)
+	if err != nil {
+		result.addPhase(PhasePodReady, start)
+		return fmt.Errorf("error waiting for controllers: %v", err)
+	}
+	result.addPhase(PhasePodReady, start)
+
+	// get endpoints for all services
+	start = time.Now()
+	services, err := matchReadinessProbes(clientset, namespace, test.NodePortServices)
+	if err != nil {
+		result.addPhase(PhasePing, start)
+		return fmt.Errorf("error matching readiness probes: %v", err)
+	}
+	var endPoints map[string]endPoint
+	if *portForward {
+		var stop func()
+		endPoints, stop, err = portForwardEndPoints(ctx, t, cluster, namespace, services)
+		if err == nil {
+			defer stop()
+		}
+	} else {
+		endPoints, err = getEndPoints(ctx, t, clientset, namespace, services)
+	}
+	if err != nil {
+		result.addPhase(PhasePing, start)
+		return fmt.Errorf("error getting nodes: %v", err)
+	}
+	result.EndPoints = make(map[string]string)
+	for k, e := range endPoints {
+		result.EndPoints[k] = e.URL
 	}
+	result.Pinged, err = pingEndPoints(ctx, t, endPoints)
+	for _, p := range result.Pinged {
+		result.Pings += p.Attempts
+	}
+	result.addPhase(PhasePing, start)
+	if err != nil {
+		return fmt.Errorf("error pinging endpoint: %v", err)
+	}
+	t.Logf("Successfully pinged all endpoints!")
+
+	if test.KubeDelete {
+		start = time.Now()
+		_, err = RunKubeDelete(ctx, t, cluster, convertedOutput, namespace)
+		result.addPhase(PhaseDelete, start)
+		if err != nil {
+			return fmt.Errorf("error running kubectl delete: %v", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,132 @@
+package e2e
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_templateFields(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{
+			name: "plain words",
+			in:   "kompose convert --stdout",
+			want: []string{"kompose", "convert", "--stdout"},
+		},
+		{
+			name: "extra spaces",
+			in:   "  kompose \t convert  ",
+			want: []string{"kompose", "convert"},
+		},
+		{
+			name: "spaces inside an action",
+			in:   `kompose convert -f {{join .Files ","}} {{ .Args }}`,
+			want: []string{"kompose", "convert", "-f", `{{join .Files ","}}`, "{{ .Args }}"},
+		},
+		{
+			name: "action inside a word",
+			in:   "gen --files={{join .Files \" \"}}",
+			want: []string{"gen", `--files={{join .Files " "}}`},
+		},
+		{
+			name: "empty",
+			in:   " ",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := templateFields(test.in); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("templateFields(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func Test_runGenerateCommand(t *testing.T) {
+	files := []string{"/tmp/my app/web.yaml", "db.yaml"}
+	tests := []struct {
+		name    string
+		command string
+		files   []string
+		args    []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "files and args",
+			command: "true convert {{.Files}} {{.Args}}",
+			files:   files,
+			args:    []string{"--stdout"},
+			// a path with spaces stays a single argument
+			want: []string{"convert", "/tmp/my app/web.yaml", "db.yaml", "--stdout"},
+		},
+		{
+			name:    "spaced actions",
+			command: "true {{ .Files }} {{ .Args }}",
+			files:   files,
+			want:    []string{"/tmp/my app/web.yaml", "db.yaml"},
+		},
+		{
+			name:    "join",
+			command: `true -f {{join .Files ","}}`,
+			files:   files,
+			want:    []string{"-f", "/tmp/my app/web.yaml,db.yaml"},
+		},
+		{
+			name:    "each file",
+			command: "true {{range .Files}}-f={{.}};{{end}}",
+			files:   files,
+			want:    []string{"-f=/tmp/my app/web.yaml;-f=db.yaml;"},
+		},
+		{
+			name:    "invalid template",
+			command: "true {{.Files",
+			files:   files,
+			wantErr: "invalid generate command",
+		},
+		{
+			name:    "empty",
+			command: " ",
+			files:   files,
+			wantErr: "is empty",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Runner{GenerateCommand: test.command}
+			result, err := r.Generate(context.Background(), test.files, nil, test.args...)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want one about %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Args, test.want) {
+				t.Errorf("ran with %q, want %q", result.Args, test.want)
+			}
+		})
+	}
+}
+
+func Test_runGenerateCommandInput(t *testing.T) {
+	r := &Runner{GenerateCommand: "cat {{.Files}}"}
+	input := []byte("name: web\n")
+	result, err := r.KappInput(context.Background(), KappGenerate, input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-"}; !reflect.DeepEqual(result.Args, want) {
+		t.Errorf("ran with %q, want %q", result.Args, want)
+	}
+	if string(result.Stdout) != string(input) {
+		t.Errorf("printed %q, want the input %q", result.Stdout, input)
+	}
+}
@@ -0,0 +1,88 @@
+package e2e
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Output  string `xml:",chardata"`
+}
+
+// junitSeconds formats d the way JUnit reports durations
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func newJUnitTestCase(result TestResult) junitTestCase {
+	tc := junitTestCase{
+		Name:      result.Name,
+		ClassName: "e2e",
+		Time:      junitSeconds(result.Duration),
+	}
+	// group the tests by the cluster they ran on
+	if result.Cluster != "" {
+		tc.ClassName = "e2e." + result.Cluster
+	}
+	if result.Err != nil {
+		tc.Failure = &junitFailure{
+			Message: "test failed",
+			Output:  result.Err.Error(),
+		}
+	}
+	return tc
+}
+
+// WriteJUnitReport writes the results to path as a single JUnit test suite
+func WriteJUnitReport(path, name string, duration time.Duration, results []TestResult) error {
+	suite := junitTestSuite{
+		Name:  name,
+		Tests: len(results),
+		Time:  junitSeconds(duration),
+	}
+	for _, result := range results {
+		suite.Cases = append(suite.Cases, newJUnitTestCase(result))
+		if result.Err != nil {
+			suite.Failures++
+		}
+	}
+
+	out, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal the JUnit report")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "cannot create the JUnit report")
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(xml.Header); err != nil {
+		return errors.Wrap(err, "cannot write the JUnit report")
+	}
+	if _, err := f.Write(out); err != nil {
+		return errors.Wrap(err, "cannot write the JUnit report")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package e2e
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseManifests(t *testing.T) {
+	const service = "apiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"
+	const deployment = "apiVersion: extensions/v1beta1\nkind: Deployment\nmetadata:\n  name: web\n"
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "objects",
+			data: service + "---\n" + deployment,
+			want: []string{"Service/web", "Deployment/web"},
+		},
+		{
+			name: "empty documents",
+			data: "---\n\n---\n" + service + "---\n",
+			want: []string{"Service/web"},
+		},
+		{
+			name: "comment only document",
+			data: "# generated\n---\n" + service,
+			want: []string{"Service/web"},
+		},
+		{
+			name: "list",
+			data: "apiVersion: v1\nkind: List\nitems:\n- " + strings.Replace(service, "\n", "\n  ", -1) + "\n- " + strings.Replace(deployment, "\n", "\n  ", -1),
+			want: []string{"Service/web", "Deployment/web"},
+		},
+		{
+			name: "list of one kind",
+			data: "apiVersion: v1\nkind: ServiceList\nitems:\n- " + strings.Replace(service, "\n", "\n  ", -1),
+			want: []string{"Service/web"},
+		},
+		{
+			name:    "list item without a kind",
+			data:    "apiVersion: v1\nkind: List\nitems:\n- " + strings.Replace(service, "\n", "\n  ", -1) + "\n- metadata:\n    name: db\n",
+			wantErr: "item 1 of document 1",
+		},
+		{
+			name:    "error after a comment only document",
+			data:    "# generated\n---\n" + service + "---\nkind: [\n",
+			wantErr: "document 3",
+		},
+		{
+			name:    "error after a list",
+			data:    "apiVersion: v1\nkind: List\nitems:\n- " + strings.Replace(service, "\n", "\n  ", -1) + "\n- " + strings.Replace(deployment, "\n", "\n  ", -1) + "\n---\n- not an object\n",
+			wantErr: "document 2",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objs, err := ParseManifests([]byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want one about %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, obj := range objs {
+				got = append(got, obj.GetKind()+"/"+obj.GetName())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package e2e
+
+import "os/exec"
+
+// setProcessGroup does nothing, there are no process groups to kill on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd only
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,212 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The phases of a test, in the order they run
+const (
+	PhaseGenerate = "generate"
+	PhaseApply    = "apply"
+	PhasePodReady = "pod-ready"
+	PhasePing     = "ping"
+	PhaseDelete   = "delete"
+	PhaseCleanup  = "cleanup"
+)
+
+// PhaseTiming is how long a phase of a test took
+type PhaseTiming struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// TestResult is the outcome of a test, Err is nil if it passed
+type TestResult struct {
+	Name string
+	// Cluster is the name of the cluster the test ran on, see -clusters
+	Cluster   string
+	Namespace string
+	Err       error
+	Duration  time.Duration
+	// Created are the kubectl names of the resources the test deployed
+	Created []string
+	// ClusterScoped are the kubectl names of the deployed resources that are
+	// not in the namespace of the test, and are deleted after it
+	ClusterScoped []string
+	// Unfinished is set when the suite was stopped before the test was done
+	Unfinished bool
+	// Phases lists the phases the test went through, a failed test stops
+	// after the phase it failed in
+	Phases []PhaseTiming
+	// PodChecks is how many times PodsStarted checked the pods, and Pings
+	// how many requests pingEndPoints sent, to tune the timeouts by
+	PodChecks int
+	Pings     int
+	// Restarts is the most restarts of a container of every pod the test
+	// waited on, a pod restarting before it started may be unstable
+	Restarts map[string]int32
+	// Attempts is how many times the test ran, more than once when it
+	// failed and -retries allowed running it again
+	Attempts int
+	// Pinged tells how pinging each service port went
+	Pinged []EndpointResult
+	// EndPoints are the URLs the service ports were reached on, by service
+	// port, e.g. "wordpress:8080", for checks of their own after the test
+	EndPoints map[string]string
+}
+
+func (r *TestResult) addPhase(phase string, start time.Time) {
+	r.Phases = append(r.Phases, PhaseTiming{Phase: phase, Duration: time.Since(start)})
+}
+
+// FullName is the name of the test, prefixed with the cluster it ran on when
+// there are several
+func (r TestResult) FullName() string {
+	if r.Cluster == "" {
+		return r.Name
+	}
+	return r.Cluster + "/" + r.Name
+}
+
+// lastPhase is the phase the test was last in, i.e. the one it failed in
+func (r TestResult) lastPhase() string {
+	if len(r.Phases) == 0 {
+		return "setup"
+	}
+	return r.Phases[len(r.Phases)-1].Phase
+}
+
+func (r TestResult) Passed() bool {
+	return r.Err == nil
+}
+
+// String formats the result as key=value fields
+func (r TestResult) String() string {
+	fields := []string{
+		fmt.Sprintf("test=%q", r.Name),
+		fmt.Sprintf("cluster=%q", r.Cluster),
+		fmt.Sprintf("namespace=%q", r.Namespace),
+		fmt.Sprintf("passed=%v", r.Passed()),
+		fmt.Sprintf("duration=%v", r.Duration),
+	}
+	for _, p := range r.Phases {
+		fields = append(fields, fmt.Sprintf("%s=%v", p.Phase, p.Duration))
+	}
+	fields = append(fields, fmt.Sprintf("pod-checks=%d", r.PodChecks), fmt.Sprintf("pings=%d", r.Pings), fmt.Sprintf("attempts=%d", r.Attempts))
+	return strings.Join(fields, " ")
+}
+
+// resultsTable lays out the results with the duration of each phase
+func resultsTable(results []TestResult) string {
+	phases := []string{PhaseGenerate, PhaseApply, PhasePodReady, PhasePing, PhaseDelete, PhaseCleanup}
+
+	var out bytes.Buffer
+	w := tabwriter.NewWriter(&out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TEST\tRESULT\tTOTAL\t%s\n", strings.ToUpper(strings.Join(phases, "\t")))
+	for _, r := range results {
+		status := "PASS"
+		if !r.Passed() {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v", r.FullName(), status, r.Duration.Round(time.Millisecond))
+		for _, phase := range phases {
+			took := "-"
+			for _, p := range r.Phases {
+				if p.Phase == phase {
+					took = p.Duration.Round(time.Millisecond).String()
+				}
+			}
+			fmt.Fprintf(w, "\t%s", took)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+	return out.String()
+}
+
+// EndpointResult is how pinging a service port went
+type EndpointResult struct {
+	// Name is the service port, e.g. "wordpress:8080"
+	Name string
+	URL  string
+	// StatusCode is the status of the last response, zero for ProtocolTCP
+	// or when there was no response
+	StatusCode int
+	// Latency is how long the last ping took
+	Latency  time.Duration
+	Attempts int
+	// Err is why the service is not up, nil when it is
+	Err error
+}
+
+// report is the summary of a run -report writes, durations are in seconds
+type report struct {
+	RunID    string       `json:"runID"`
+	Duration float64      `json:"duration"`
+	Tests    int          `json:"tests"`
+	Failures int          `json:"failures"`
+	Results  []testReport `json:"results"`
+}
+
+type testReport struct {
+	Name      string             `json:"name"`
+	Cluster   string             `json:"cluster,omitempty"`
+	Namespace string             `json:"namespace"`
+	Passed    bool               `json:"passed"`
+	Duration  float64            `json:"duration"`
+	Phases    map[string]float64 `json:"phases"`
+	Attempts  int                `json:"attempts"`
+	Error     string             `json:"error,omitempty"`
+}
+
+func newTestReport(result TestResult) testReport {
+	tr := testReport{
+		Name:      result.Name,
+		Cluster:   result.Cluster,
+		Namespace: result.Namespace,
+		Passed:    result.Passed(),
+		Duration:  result.Duration.Seconds(),
+		Phases:    make(map[string]float64),
+		Attempts:  result.Attempts,
+	}
+	for _, p := range result.Phases {
+		tr.Phases[p.Phase] = p.Duration.Seconds()
+	}
+	if result.Err != nil {
+		tr.Error = result.Err.Error()
+	}
+	return tr
+}
+
+// WriteReport writes the results of the run with the given id to path as JSON
+func WriteReport(path, runID string, duration time.Duration, results []TestResult) error {
+	r := report{
+		RunID:    runID,
+		Duration: duration.Seconds(),
+		Tests:    len(results),
+		Results:  []testReport{},
+	}
+	for _, result := range results {
+		r.Results = append(r.Results, newTestReport(result))
+		if result.Err != nil {
+			r.Failures++
+		}
+	}
+
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal the report")
+	}
+	if err := ioutil.WriteFile(path, append(out, '\n'), 0644); err != nil {
+		return errors.Wrap(err, "cannot write the report")
+	}
+	return nil
+}